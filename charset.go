@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+)
+
+// Charset defines the character sets that can be designated to the
+// G0-G3 graphic sets.
+type Charset int
+
+// Character sets.
+const (
+	CharsetASCII Charset = iota
+	CharsetDECSpecialGraphics
+	CharsetUK
+)
+
+var charsetNames = map[Charset]string{
+	CharsetASCII:              "ASCII",
+	CharsetDECSpecialGraphics: "DEC Special Graphics",
+	CharsetUK:                 "UK",
+}
+
+func (cs Charset) String() string {
+	name, ok := charsetNames[cs]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{Charset %d}", cs)
+}
+
+// charsetFinals map the SCS final characters to character sets.
+var charsetFinals = map[int]Charset{
+	'B': CharsetASCII,
+	'0': CharsetDECSpecialGraphics,
+	'A': CharsetUK,
+}
+
+// decSpecialGraphics maps the 0x5f-0x7e range of the DEC Special
+// Graphics character set to Unicode.
+var decSpecialGraphics = [...]rune{
+	0x00a0, // _ blank
+	0x25c6, // ` diamond
+	0x2592, // a checkerboard
+	0x2409, // b HT
+	0x240c, // c FF
+	0x240d, // d CR
+	0x240a, // e LF
+	0x00b0, // f degree symbol
+	0x00b1, // g plus/minus
+	0x2424, // h NL
+	0x240b, // i VT
+	0x2518, // j lower-right corner
+	0x2510, // k upper-right corner
+	0x250c, // l upper-left corner
+	0x2514, // m lower-left corner
+	0x253c, // n crossing lines
+	0x23ba, // o scan line 1
+	0x23bb, // p scan line 3
+	0x2500, // q scan line 5, horizontal line
+	0x23bc, // r scan line 7
+	0x23bd, // s scan line 9
+	0x251c, // t left tee
+	0x2524, // u right tee
+	0x2534, // v bottom tee
+	0x252c, // w top tee
+	0x2502, // x vertical bar
+	0x2264, // y less than or equal to
+	0x2265, // z greater than or equal to
+	0x03c0, // { pi
+	0x2260, // | not equal to
+	0x00a3, // } UK pound sign
+	0x00b7, // ~ centered dot
+}
+
+// Map maps the code to the character set.
+func (cs Charset) Map(code int) int {
+	switch cs {
+	case CharsetDECSpecialGraphics:
+		if code >= 0x5f && code <= 0x7e {
+			return int(decSpecialGraphics[code-0x5f])
+		}
+	case CharsetUK:
+		if code == '#' {
+			return 0x00a3
+		}
+	}
+	return code
+}
+
+// charsets define the G0-G3 character set designations and their
+// invocation state.
+type charsets struct {
+	g           [4]Charset
+	gl          int
+	singleShift int
+}
+
+// designate designates the character set to the graphic set G0-G3
+// identified by the SCS intermediate character.
+func (c *charsets) designate(intermediate byte, cs Charset) {
+	switch intermediate {
+	case '(':
+		c.g[0] = cs
+	case ')':
+		c.g[1] = cs
+	case '*':
+		c.g[2] = cs
+	case '+':
+		c.g[3] = cs
+	}
+}
+
+// translate maps the code through the active character set. Single
+// shifts apply to the next graphic character only.
+func (c *charsets) translate(code int) int {
+	g := c.gl
+	if c.singleShift != 0 {
+		g = c.singleShift
+		c.singleShift = 0
+	}
+	if code < 0x20 || code > 0x7e {
+		return code
+	}
+	return c.g[g].Map(code)
+}
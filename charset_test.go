@@ -0,0 +1,56 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"testing"
+)
+
+var charsetTests = []struct {
+	i string
+	o string
+}{
+	{
+		i: "\x1b(0lqqk\x1b(Bq",
+		o: "┌──┐q",
+	},
+	{
+		i: "\x1b)0a\x0eqx\x0fq",
+		o: "a─│q",
+	},
+	{
+		i: "\x1b(A#\x1b(B#",
+		o: "£#",
+	},
+	{
+		i: "\x1b*0\x1b+Aq\x1bNq\x1bO#q#",
+		o: "q─£q#",
+	},
+	{
+		i: "\x1b*0\x1bnq\x1b(B\x0fq",
+		o: "─q",
+	},
+	{
+		i: "\x1b(0\x1b7\x1b(Bq\x1b8\x1b[2Gq",
+		o: "q─",
+	},
+}
+
+func TestCharsets(t *testing.T) {
+	for idx, test := range charsetTests {
+		emul, display := newTestEmulator(10, 1)
+		emul.Write([]byte(test.i))
+
+		var runes []rune
+		for _, ch := range display.Lines[0][:len([]rune(test.o))] {
+			runes = append(runes, ch.Code)
+		}
+		if string(runes) != test.o {
+			t.Errorf("test %d: got %q, expected %q", idx, string(runes), test.o)
+		}
+	}
+}
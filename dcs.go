@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"unicode/utf8"
+)
+
+// DCSHandler handles the device control strings. The params argument
+// holds the DCS parameters and data holds the string data between
+// the final byte and the string terminator. The arguments are valid
+// only during the handler call.
+type DCSHandler func(e *Emulator, params *Params, data []byte)
+
+// dcsHandlers define the built-in device control string handlers.
+var dcsHandlers = map[string]DCSHandler{
+	"$q": dcsDECRQSS,
+}
+
+// SetDCSHandler sets the handler for the device control strings with
+// the intermediates and final byte. The intermediates include the
+// private markers. The nil handler removes the handler.
+func (e *Emulator) SetDCSHandler(intermediates string, final byte,
+	handler DCSHandler) {
+	key := intermediates + string(rune(final))
+	if handler == nil {
+		delete(e.dcsHandlers, key)
+	} else {
+		e.dcsHandlers[key] = handler
+	}
+}
+
+// StringHandler handles the SOS, PM, and APC control strings. The
+// data argument is valid only during the handler call.
+type StringHandler func(e *Emulator, kind StringKind, data []byte)
+
+// SetStringHandler sets the handler for the SOS, PM, and APC control
+// strings. The control string data is never written to the display.
+// The nil handler removes the handler and the control strings are
+// ignored.
+func (e *Emulator) SetStringHandler(handler StringHandler) {
+	e.stringHandler = handler
+}
+
+// dcsString holds the device control string that is being received.
+type dcsString struct {
+	handler DCSHandler
+	params  Params
+	data    []byte
+	full    bool
+}
+
+// put appends the character to the string data. The data is limited
+// to maxStringLength bytes.
+func (dcs *dcsString) put(r rune) {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	if len(dcs.data)+n > maxStringLength {
+		dcs.full = true
+		return
+	}
+	dcs.data = append(dcs.data, buf[:n]...)
+}
+
+// dcsDECRQSS handles the Request Selection or Setting (DECRQSS)
+// requests. The reply is DCS 1 $ r D...D ST for the valid requests
+// and DCS 0 $ r ST for the invalid requests.
+func dcsDECRQSS(e *Emulator, params *Params, data []byte) {
+	var reply string
+	switch string(data) {
+	case "m": // SGR
+		reply = e.sgrReport() + "m"
+
+	case "r": // DECSTBM
+		reply = fmt.Sprintf("%d;%dr", e.scrollTop+1, e.scrollBottom+1)
+
+	case "s": // DECSLRM
+		reply = fmt.Sprintf("%d;%ds", e.scrollLeft+1, e.scrollRight+1)
+
+	case " q": // DECSCUSR
+		reply = fmt.Sprintf("%d q", e.CursorStyle)
+
+	default:
+		e.debug("unsupported DECRQSS: %q", data)
+		e.output("\x1bP0$r\x1b\\")
+		return
+	}
+	e.output("\x1bP1$r%s\x1b\\", reply)
+}
+
+// sgrReport returns the SGR parameters of the current character
+// rendition.
+func (e *Emulator) sgrReport() string {
+	params := []string{"0"}
+	add := func(format string, a ...interface{}) {
+		params = append(params, fmt.Sprintf(format, a...))
+	}
+	ch := &e.ch
+	if ch.Bold {
+		add("1")
+	}
+	if ch.Dim {
+		add("2")
+	}
+	if ch.Italic {
+		add("3")
+	}
+	switch ch.UnderlineStyle {
+	case UnderlineNone:
+	case UnderlineSingle:
+		add("4")
+	default:
+		// The double underline is reported as 4:2 since many
+		// terminals interpret SGR 21 as bold off.
+		add("4:%d", ch.UnderlineStyle)
+	}
+	if ch.Blink {
+		add("5")
+	}
+	if ch.RapidBlink {
+		add("6")
+	}
+	if ch.Reverse {
+		add("7")
+	}
+	if ch.Conceal {
+		add("8")
+	}
+	if ch.Strikethrough {
+		add("9")
+	}
+	if ch.Overline {
+		add("53")
+	}
+	if ch.Foreground != e.Default.Foreground {
+		add("%s", e.sgrColor(ch.Foreground, 30, 90, 38))
+	}
+	if ch.Background != e.Default.Background {
+		add("%s", e.sgrColor(ch.Background, 40, 100, 48))
+	}
+	if ch.UnderlineColor != e.Default.UnderlineColor {
+		add("%s", e.sgrColor(ch.UnderlineColor, -1, -1, 58))
+	}
+	return strings.Join(params, ";")
+}
+
+// sgrColor returns the SGR parameters for the color. The function
+// uses the ANSI color attributes base and bright if the color is one
+// of the 16 ANSI colors of the palette, and the extended color
+// attribute ext otherwise. The negative base and bright disable the
+// ANSI color attributes.
+func (e *Emulator) sgrColor(c color.NRGBA, base, bright, ext int) string {
+	for i, pc := range e.palette.Colors {
+		if pc != c {
+			continue
+		}
+		switch {
+		case i < 8 && base >= 0:
+			return fmt.Sprintf("%d", base+i)
+		case i < 16 && bright >= 0:
+			return fmt.Sprintf("%d", bright+i-8)
+		default:
+			return fmt.Sprintf("%d;5;%d", ext, i)
+		}
+	}
+	return fmt.Sprintf("%d;2;%d;%d;%d", ext, c.R, c.G, c.B)
+}
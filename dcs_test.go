@@ -0,0 +1,127 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var decrqssTests = []struct {
+	i string
+	o string
+}{
+	{
+		i: "\x1bP$qm\x1b\\",
+		o: "\x1bP1$r0m\x1b\\",
+	},
+	{
+		i: "\x1b[1;4;7;31;102m\x1bP$qm\x1b\\",
+		o: "\x1bP1$r0;1;4;7;31;102m\x1b\\",
+	},
+	{
+		i: "\x1b[3;4:3;38;5;200;48;2;1;2;3;58;5;1m\x1bP$qm\x1b\\",
+		o: "\x1bP1$r0;3;4:3;38;5;200;48;2;1;2;3;58;5;1m\x1b\\",
+	},
+	{
+		i: "\x1b[21m\x1bP$qm\x1b\\\x1b[4:2m\x1bP$qm\x1b\\",
+		o: "\x1bP1$r0;4:2m\x1b\\\x1bP1$r0;4:2m\x1b\\",
+	},
+	{
+		i: "\x1b[2;4r\x1bP$qr\x1b\\",
+		o: "\x1bP1$r2;4r\x1b\\",
+	},
+	{
+		i: "\x1bP$qs\x1b\\\x1b[?69h\x1b[3;6s\x1bP$qs\x1b\\",
+		o: "\x1bP1$r1;10s\x1b\\\x1bP1$r3;6s\x1b\\",
+	},
+	{
+		i: "\x1bP$q q\x1b\\\x1b[6 q\x1bP$q q\x1b\\\x1b[0 q\u0090$q q\u009c",
+		o: "\x1bP1$r1 q\x1b\\\x1bP1$r6 q\x1b\\\x1bP1$r1 q\x1b\\",
+	},
+	{
+		i: "\x1bP$qx\x1b\\",
+		o: "\x1bP0$r\x1b\\",
+	},
+	{ // Aborted request is not answered
+		i: "\x1bP$qm\x18",
+		o: "",
+	},
+}
+
+func TestDECRQSS(t *testing.T) {
+	for idx, test := range decrqssTests {
+		var out bytes.Buffer
+		emul := NewEmulator(&out, nil, NewDisplay(10, 5))
+		emul.Write([]byte(test.i))
+		if out.String() != test.o {
+			t.Errorf("test %d: got %q, expected %q", idx, out.String(), test.o)
+		}
+	}
+}
+
+func TestDCSHandler(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+
+	var calls []string
+	emul.SetDCSHandler("=", 'x', func(e *Emulator, params *Params,
+		data []byte) {
+		calls = append(calls, fmt.Sprintf("%s %s", params, data))
+	})
+	emul.Write([]byte("a\x1bP=1;2xdata\x1b\\b"))
+	emul.Write([]byte("\x1bP=x\x1b\\\x1bPxignored\x1b\\c"))
+	emul.Write([]byte("\x1bP=x" + strings.Repeat("x", maxStringLength+1) +
+		"\x1b\\"))
+
+	expected := []string{"1;2 data", " "}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", calls, expected)
+	}
+	line := strings.TrimRight(lineString(display, 0), " ")
+	if line != "abc" {
+		t.Errorf("got %q, expected %q", line, "abc")
+	}
+
+	emul.SetDCSHandler("=", 'x', nil)
+	emul.Write([]byte("\x1bP=xdata\x1b\\"))
+	if len(calls) != len(expected) {
+		t.Errorf("removed handler called")
+	}
+}
+
+func TestStringHandler(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+
+	var calls []string
+	emul.SetStringHandler(func(e *Emulator, kind StringKind, data []byte) {
+		calls = append(calls, fmt.Sprintf("%s %s", kind, data))
+	})
+	emul.Write([]byte("a\x1b_Gf=100;AAAA\x1b\\b\x1b^pm\x1b\\\x1bXsos\x1b\\c"))
+	emul.Write([]byte("\x1b_" + strings.Repeat("x", maxStringLength+1) +
+		"\x1b\\"))
+
+	expected := []string{"APC Gf=100;AAAA", "PM pm", "SOS sos"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", calls, expected)
+	}
+	line := strings.TrimRight(lineString(display, 0), " ")
+	if line != "abc" {
+		t.Errorf("got %q, expected %q", line, "abc")
+	}
+
+	emul.SetStringHandler(nil)
+	emul.Write([]byte("\x1b_apc\x1b\\d"))
+	if len(calls) != len(expected) {
+		t.Errorf("removed handler called")
+	}
+	line = strings.TrimRight(lineString(display, 0), " ")
+	if line != "abcd" {
+		t.Errorf("got %q, expected %q", line, "abcd")
+	}
+}
@@ -8,13 +8,39 @@ package vt100
 
 var (
 	_ CharDisplay = &Display{}
+	_ RectDisplay = &Display{}
 )
 
-// Display implements fixed size CharDisplay.
+// Display implements fixed size CharDisplay. The display keeps a
+// bounded scrollback history of the lines that scroll off the top of
+// the screen.
 type Display struct {
 	Blank Char
 	size  Point
 	Lines [][]Char
+	attrs []lineAttrs
+
+	// The inactive screen buffer and a flag telling if the alternate
+	// screen buffer is active.
+	other      [][]Char
+	otherAttrs []lineAttrs
+	alternate  bool
+
+	scrollback      []historyLine
+	scrollbackStart int
+	scrollbackLen   int
+}
+
+// lineAttrs define the display line attributes.
+type lineAttrs struct {
+	wrapped bool
+	size    LineSize
+}
+
+// historyLine defines a scrollback history line.
+type historyLine struct {
+	chars []Char
+	attrs lineAttrs
 }
 
 // NewDisplay creates a display with the given dimensions.
@@ -39,21 +65,28 @@ func (d *Display) Resize(width, height int) {
 	d.size.X = width
 	d.size.Y = height
 
+	d.Lines = d.resizeLines(d.Lines, width, height)
+	for len(d.attrs) < height {
+		d.attrs = append(d.attrs, lineAttrs{})
+	}
+	if d.other != nil {
+		d.other = d.resizeLines(d.other, width, height)
+		for len(d.otherAttrs) < height {
+			d.otherAttrs = append(d.otherAttrs, lineAttrs{})
+		}
+	}
+}
+
+func (d *Display) resizeLines(lines [][]Char, width, height int) [][]Char {
 	for row := 0; row < height; row++ {
-		var line []Char
-		var start int
-		if row < len(d.Lines) {
-			line = d.Lines[row]
-			start = len(line)
-		} else {
-			line = make([]Char, width)
-			start = 0
-			d.Lines = append(d.Lines, line)
+		if row >= len(lines) {
+			lines = append(lines, make([]Char, 0, width))
 		}
-		for col := start; col < width; col++ {
-			line[col] = d.Blank
+		for len(lines[row]) < width {
+			lines[row] = append(lines[row], d.Blank)
 		}
 	}
+	return lines
 }
 
 // Size implements the CharDisplay.Size function.
@@ -61,12 +94,19 @@ func (d *Display) Size() Point {
 	return d.size
 }
 
-// Clear implements the CharDisplay.Clear function.
+// Clear implements the CharDisplay.Clear function. Clearing the last
+// column of a line clears the line's soft wrap flag and clearing the
+// full line resets the line size to single width.
 func (d *Display) Clear(from, to Point) {
 	for y := from.Y; y <= to.Y; y++ {
 		for x := from.X; x <= to.X; x++ {
 			d.Lines[y][x] = d.Blank
 		}
+		d.fixWide(d.Lines[y], from.X-1, from.X-1)
+		d.fixWide(d.Lines[y], to.X+1, to.X+1)
+		if to.X >= d.size.X-1 {
+			d.attrs[y].wrapped = false
+		}
 	}
 }
 
@@ -79,12 +119,98 @@ func (d *Display) DECALN(size Point) {
 		for x := 0; x < size.X; x++ {
 			d.Lines[y][x] = ch
 		}
+		d.attrs[y] = lineAttrs{}
 	}
 }
 
-// Set implements the CharDisplay.Set function.
+// Set implements the CharDisplay.Set function. If the character
+// overwrites a half of a wide character, the other half is cleared.
 func (d *Display) Set(p Point, char Char) {
-	d.Lines[p.Y][p.X] = char
+	line := d.Lines[p.Y]
+	old := line[p.X]
+	if old.Continuation && !char.Continuation && p.X > 0 {
+		line[p.X-1] = d.Blank
+	}
+	if old.Wide && !char.Wide && p.X+1 < len(line) &&
+		line[p.X+1].Continuation {
+		line[p.X+1] = d.Blank
+	}
+	line[p.X] = char
+}
+
+// Get implements the CharDisplay.Get function.
+func (d *Display) Get(p Point) Char {
+	if p.Y < 0 || p.Y >= d.size.Y || p.X < 0 || p.X >= d.size.X {
+		return d.Blank
+	}
+	return d.Lines[p.Y][p.X]
+}
+
+// FillRect implements the RectDisplay.FillRect function.
+func (d *Display) FillRect(from, to Point, char Char) {
+	for y := from.Y; y <= to.Y; y++ {
+		line := d.Lines[y]
+		for x := from.X; x <= to.X; x++ {
+			line[x] = char
+		}
+		d.fixWide(line, from.X-1, from.X-1)
+		d.fixWide(line, to.X+1, to.X+1)
+	}
+}
+
+// CopyRect implements the RectDisplay.CopyRect function.
+func (d *Display) CopyRect(from, to, dst Point) {
+	var rows [][]Char
+	for y := from.Y; y <= to.Y; y++ {
+		rows = append(rows, append([]Char(nil), d.Lines[y][from.X:to.X+1]...))
+	}
+	for i, row := range rows {
+		line := d.Lines[dst.Y+i]
+		n := copy(line[dst.X:], row)
+		d.fixWide(line, dst.X-1, dst.X)
+		d.fixWide(line, dst.X+n-1, dst.X+n)
+	}
+}
+
+// ModifyRect implements the RectDisplay.ModifyRect function.
+func (d *Display) ModifyRect(from, to Point, modify func(ch Char) Char) {
+	for y := from.Y; y <= to.Y; y++ {
+		line := d.Lines[y]
+		for x := from.X; x <= to.X; x++ {
+			line[x] = modify(line[x])
+		}
+	}
+}
+
+// SelectiveErase implements the RectDisplay.SelectiveErase function.
+func (d *Display) SelectiveErase(from, to Point) {
+	for y := from.Y; y <= to.Y; y++ {
+		line := d.Lines[y]
+		for x := from.X; x <= to.X; x++ {
+			if !line[x].Protected {
+				line[x] = d.Blank
+			}
+		}
+		d.fixWide(line, from.X-1, to.X+1)
+	}
+}
+
+// fixWide clears the halves of wide characters that have lost their
+// other half in the column range from-to (inclusively).
+func (d *Display) fixWide(line []Char, from, to int) {
+	if from < 0 {
+		from = 0
+	}
+	if to >= len(line) {
+		to = len(line) - 1
+	}
+	for x := from; x <= to; x++ {
+		if line[x].Wide && (x+1 >= len(line) || !line[x+1].Continuation) {
+			line[x] = d.Blank
+		} else if line[x].Continuation && (x == 0 || !line[x-1].Wide) {
+			line[x] = d.Blank
+		}
+	}
 }
 
 // InsertChars implements the CharDisplay.InsertChars function.
@@ -102,6 +228,7 @@ func (d *Display) InsertChars(size, p Point, count int) {
 		line = append(line, d.Lines[p.Y][x])
 	}
 	line = append(line, d.Lines[p.Y][size.X:]...)
+	d.fixWide(line, 0, size.X-1)
 	d.Lines[p.Y] = line
 }
 
@@ -120,30 +247,261 @@ func (d *Display) DeleteChars(size, p Point, count int) {
 		line = append(line, d.Blank)
 	}
 	line = append(line, d.Lines[p.Y][size.X:]...)
+	d.fixWide(line, 0, size.X-1)
 	d.Lines[p.Y] = line
 }
 
-// ScrollUp implements the CharDisplay.ScrollUp function.
-func (d *Display) ScrollUp(top, bottom, count int) {
-	var lines [][]Char
+// ScrollUp implements the CharDisplay.ScrollUp function. The lines
+// are pushed to the scrollback history if the primary screen is
+// active and the scroll region covers the full screen.
+func (d *Display) ScrollUp(top, bottom, left, right, count int) {
+	if top == 0 && bottom == d.size.Y-1 && d.fullWidth(left, right) &&
+		!d.alternate {
+		for i := 0; i < count; i++ {
+			d.Lines[top+i] = d.pushScrollback(d.Lines[top+i], d.attrs[top+i])
+		}
+	}
+	d.DeleteLines(top, bottom, left, right, count)
+}
+
+// ScrollDown implements the CharDisplay.ScrollDown function.
+func (d *Display) ScrollDown(top, bottom, left, right, count int) {
+	d.InsertLines(top, bottom, left, right, count)
+}
 
-	for i := 0; i < top; i++ {
-		lines = append(lines, d.Lines[i])
+// InsertLines implements the CharDisplay.InsertLines function.
+func (d *Display) InsertLines(row, bottom, left, right, count int) {
+	if count > bottom-row+1 {
+		count = bottom - row + 1
 	}
-	for i := top + count; i <= bottom; i++ {
-		lines = append(lines, d.Lines[i])
+	if !d.fullWidth(left, right) {
+		for y := bottom; y >= row+count; y-- {
+			d.copyCells(y, y-count, left, right)
+		}
+		for y := row; y < row+count; y++ {
+			d.clearCells(y, left, right)
+		}
+		return
 	}
-	for i := 0; i < count; i++ {
-		line := d.Lines[top+i]
+	removed := append([][]Char(nil), d.Lines[bottom-count+1:bottom+1]...)
+	copy(d.Lines[row+count:bottom+1], d.Lines[row:bottom+1-count])
+	copy(d.attrs[row+count:bottom+1], d.attrs[row:bottom+1-count])
+	for i, line := range removed {
+		d.clearLine(line)
+		d.Lines[row+i] = line
+		d.attrs[row+i] = lineAttrs{}
+	}
+}
 
-		for j := 0; j < len(line); j++ {
-			line[j] = d.Blank
+// DeleteLines implements the CharDisplay.DeleteLines function.
+func (d *Display) DeleteLines(row, bottom, left, right, count int) {
+	if count > bottom-row+1 {
+		count = bottom - row + 1
+	}
+	if !d.fullWidth(left, right) {
+		for y := row; y <= bottom-count; y++ {
+			d.copyCells(y, y+count, left, right)
 		}
+		for y := bottom - count + 1; y <= bottom; y++ {
+			d.clearCells(y, left, right)
+		}
+		return
+	}
+	removed := append([][]Char(nil), d.Lines[row:row+count]...)
+	copy(d.Lines[row:bottom+1-count], d.Lines[row+count:bottom+1])
+	copy(d.attrs[row:bottom+1-count], d.attrs[row+count:bottom+1])
+	for i, line := range removed {
+		d.clearLine(line)
+		d.Lines[bottom-count+1+i] = line
+		d.attrs[bottom-count+1+i] = lineAttrs{}
+	}
+}
+
+// fullWidth tests if the column range covers the full screen width.
+func (d *Display) fullWidth(left, right int) bool {
+	return left == 0 && right >= d.size.X-1
+}
+
+// copyCells copies the column range left-right from the line src to
+// the line dst.
+func (d *Display) copyCells(dst, src, left, right int) {
+	copy(d.Lines[dst][left:right+1], d.Lines[src][left:right+1])
+	d.fixWide(d.Lines[dst], left-1, right+1)
+}
 
-		lines = append(lines, line)
+// clearCells clears the column range left-right of the line.
+func (d *Display) clearCells(row, left, right int) {
+	line := d.Lines[row]
+	for x := left; x <= right; x++ {
+		line[x] = d.Blank
+	}
+	d.fixWide(line, left-1, right+1)
+}
+
+func (d *Display) clearLine(line []Char) {
+	for i := range line {
+		line[i] = d.Blank
+	}
+}
+
+// SwitchScreen implements the CharDisplay.SwitchScreen function. The
+// alternate screen buffer is created blank when it is first
+// activated.
+func (d *Display) SwitchScreen(alternate bool) {
+	if alternate == d.alternate {
+		return
+	}
+	if d.other == nil {
+		d.other = d.resizeLines(nil, d.size.X, d.size.Y)
+		d.otherAttrs = make([]lineAttrs, len(d.other))
+	}
+	d.Lines, d.other = d.other, d.Lines
+	d.attrs, d.otherAttrs = d.otherAttrs, d.attrs
+	d.alternate = alternate
+}
+
+// SetWrapped implements the CharDisplay.SetWrapped function.
+func (d *Display) SetWrapped(row int, wrapped bool) {
+	d.attrs[row].wrapped = wrapped
+}
+
+// SetLineSize implements the CharDisplay.SetLineSize function.
+func (d *Display) SetLineSize(row int, size LineSize) {
+	d.attrs[row].size = size
+}
+
+// LineSize implements the CharDisplay.LineSize function. Renderers
+// draw the characters of the double width lines scaled to two
+// columns, and the double height lines scaled to two rows, showing
+// the top or the bottom half of the characters.
+func (d *Display) LineSize(row int) LineSize {
+	return d.attrs[row].size
+}
+
+// Wrapped tests if the line is soft wrapped i.e. it continues on the
+// next line.
+func (d *Display) Wrapped(row int) bool {
+	return d.attrs[row].wrapped
+}
+
+// Alternate tests if the alternate screen buffer is active.
+func (d *Display) Alternate() bool {
+	return d.alternate
+}
+
+// SetScrollbackLimit sets the maximum number of lines in the
+// scrollback history. The value 0 disables the scrollback
+// history. If the history has more lines than the new limit, the
+// oldest lines are dropped.
+func (d *Display) SetScrollbackLimit(lines int) {
+	if lines < 0 {
+		lines = 0
+	}
+	n := d.scrollbackLen
+	if n > lines {
+		n = lines
+	}
+	history := make([]historyLine, lines)
+	for i := 0; i < n; i++ {
+		history[i] = d.historyLine(d.scrollbackLen - n + i)
+	}
+	d.scrollback = history
+	d.scrollbackStart = 0
+	d.scrollbackLen = n
+}
+
+// ScrollbackLimit returns the maximum number of lines in the
+// scrollback history.
+func (d *Display) ScrollbackLimit() int {
+	return len(d.scrollback)
+}
+
+// ScrollbackLen returns the number of lines in the scrollback
+// history.
+func (d *Display) ScrollbackLen() int {
+	return d.scrollbackLen
+}
+
+// ScrollbackLine returns the scrollback history line idx. The lines
+// are indexed from 0 (oldest) to ScrollbackLen()-1 (newest). The
+// returned line shares memory with the display and it is valid until
+// the next scroll operation.
+func (d *Display) ScrollbackLine(idx int) []Char {
+	return d.historyLine(idx).chars
+}
+
+// ScrollbackLineSize returns the line size attribute of the
+// scrollback history line idx.
+func (d *Display) ScrollbackLineSize(idx int) LineSize {
+	return d.historyLine(idx).attrs.size
+}
+
+// ScrollbackWrapped tests if the scrollback history line idx is soft
+// wrapped i.e. it continues on the next line.
+func (d *Display) ScrollbackWrapped(idx int) bool {
+	return d.historyLine(idx).attrs.wrapped
+}
+
+func (d *Display) historyLine(idx int) historyLine {
+	if idx < 0 || idx >= d.scrollbackLen {
+		return historyLine{}
+	}
+	return d.scrollback[(d.scrollbackStart+idx)%len(d.scrollback)]
+}
+
+// ScrollbackPage returns at most count scrollback history lines,
+// ending offset lines before the newest history line. The lines are
+// returned from oldest to newest. The page of height h, n pages above
+// the screen is returned by ScrollbackPage(n*h, h).
+func (d *Display) ScrollbackPage(offset, count int) [][]Char {
+	end := d.scrollbackLen - offset
+	if end > d.scrollbackLen {
+		end = d.scrollbackLen
+	}
+	start := end - count
+	if start < 0 {
+		start = 0
+	}
+	var lines [][]Char
+	for i := start; i < end; i++ {
+		lines = append(lines, d.ScrollbackLine(i))
+	}
+	return lines
+}
+
+// ClearScrollback implements the CharDisplay.ClearScrollback
+// function.
+func (d *Display) ClearScrollback() {
+	for i := range d.scrollback {
+		d.scrollback[i] = historyLine{}
+	}
+	d.scrollbackStart = 0
+	d.scrollbackLen = 0
+}
+
+// pushScrollback pushes the line to the scrollback history. The
+// function returns a line that the caller can use as a new blank
+// line. If the history is full, the evicted oldest line is reused.
+func (d *Display) pushScrollback(line []Char, attrs lineAttrs) []Char {
+	if len(d.scrollback) == 0 {
+		return line
+	}
+	entry := historyLine{
+		chars: line,
+		attrs: attrs,
+	}
+	var free []Char
+	if d.scrollbackLen == len(d.scrollback) {
+		free = d.scrollback[d.scrollbackStart].chars
+		d.scrollback[d.scrollbackStart] = entry
+		d.scrollbackStart = (d.scrollbackStart + 1) % len(d.scrollback)
+	} else {
+		idx := (d.scrollbackStart + d.scrollbackLen) % len(d.scrollback)
+		d.scrollback[idx] = entry
+		d.scrollbackLen++
 	}
-	for i := bottom + 1; i < len(d.Lines); i++ {
-		lines = append(lines, d.Lines[i])
+	if cap(free) >= len(line) {
+		return free[:len(line)]
 	}
-	d.Lines = lines
+	return make([]Char, len(line))
 }
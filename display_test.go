@@ -0,0 +1,179 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func charsString(line []Char) string {
+	var sb strings.Builder
+	for _, ch := range line {
+		if ch.Code == 0xa0 {
+			sb.WriteRune(' ')
+		} else {
+			sb.WriteString(ch.Grapheme())
+		}
+	}
+	return sb.String()
+}
+
+func TestScrollback(t *testing.T) {
+	emul, display := newTestEmulator(4, 2)
+	display.SetScrollbackLimit(3)
+
+	emul.Write([]byte("l1\r\nl2\r\nl3\r\nl4\r\nl5\r\nl6"))
+
+	if display.ScrollbackLen() != 3 {
+		t.Fatalf("ScrollbackLen: got %d, expected 3", display.ScrollbackLen())
+	}
+	for i, expected := range []string{"l2  ", "l3  ", "l4  "} {
+		got := charsString(display.ScrollbackLine(i))
+		if got != expected {
+			t.Errorf("ScrollbackLine(%d): got %q, expected %q",
+				i, got, expected)
+		}
+	}
+	for i, expected := range []string{"l5  ", "l6  "} {
+		got := lineString(display, i)
+		if got != expected {
+			t.Errorf("line %d: got %q, expected %q", i, got, expected)
+		}
+	}
+
+	page := display.ScrollbackPage(1, 2)
+	if len(page) != 2 || charsString(page[0]) != "l2  " ||
+		charsString(page[1]) != "l3  " {
+		t.Errorf("ScrollbackPage: unexpected result: %v", page)
+	}
+
+	display.SetScrollbackLimit(2)
+	if display.ScrollbackLen() != 2 ||
+		charsString(display.ScrollbackLine(0)) != "l3  " {
+		t.Errorf("SetScrollbackLimit: unexpected history")
+	}
+
+	// Partial scroll regions do not push lines to history.
+	emul.Write([]byte("\x1b[2;2r\x1b[2Hx\n"))
+	if display.ScrollbackLen() != 2 {
+		t.Errorf("partial scroll region pushed to history")
+	}
+
+	emul.Write([]byte("\x1b[3J"))
+	if display.ScrollbackLen() != 0 {
+		t.Errorf("ED 3 did not clear history")
+	}
+}
+
+// contentDisplay limits its content to the first rows and records
+// the line size changes.
+type contentDisplay struct {
+	*Display
+	rows  int
+	sizes []int
+}
+
+func (d *contentDisplay) ContentSize() Point {
+	return Point{X: d.Size().X, Y: d.rows}
+}
+
+func (d *contentDisplay) SetLineSize(row int, size LineSize) {
+	d.sizes = append(d.sizes, row)
+	d.Display.SetLineSize(row, size)
+}
+
+func TestLineSizeContent(t *testing.T) {
+	display := &contentDisplay{
+		Display: NewDisplay(10, 100),
+		rows:    2,
+	}
+	emul := NewEmulator(nil, nil, display)
+	emul.Write([]byte("\x1b#6"))
+	display.sizes = nil
+	emul.Write([]byte("\x1b[2J"))
+	if display.LineSize(0) != LineSingle {
+		t.Errorf("ED did not reset line size")
+	}
+	if fmt.Sprint(display.sizes) != "[0 1]" {
+		t.Errorf("ED reset line sizes %v", display.sizes)
+	}
+}
+
+func TestLineSizeNarrow(t *testing.T) {
+	emul, display := newTestEmulator(1, 2)
+	emul.Write([]byte("\x1b#6x\x1b[2H\x1b#3y"))
+	if display.LineSize(0) != LineDoubleWidth ||
+		display.LineSize(1) != LineDoubleHeightTop {
+		t.Errorf("got %v, %v", display.LineSize(0), display.LineSize(1))
+	}
+	if lineString(display, 0) != "x" || lineString(display, 1) != "y" {
+		t.Errorf("got %q", screenLines(display))
+	}
+}
+
+func TestLineSize(t *testing.T) {
+	emul, display := newTestEmulator(10, 4)
+
+	emul.Write([]byte("0123456789\x1b#6\x1b[1;10H"))
+	if display.LineSize(0) != LineDoubleWidth {
+		t.Errorf("DECDWL: got %v", display.LineSize(0))
+	}
+	if lineString(display, 0) != "01234     " {
+		t.Errorf("DECDWL did not clear right half: %q", lineString(display, 0))
+	}
+	if emul.Cursor.X != 4 {
+		t.Errorf("DECDWL: cursor %v", emul.Cursor)
+	}
+	emul.Write([]byte("\rabcdefg"))
+	if lineString(display, 0) != "abcde     " ||
+		lineString(display, 1) != "fg        " {
+		t.Errorf("DECDWL wrap: %q", screenLines(display))
+	}
+
+	emul.Write([]byte("\x1b[3H\x1b#3\x1b[4H\x1b#4\x1b[2K"))
+	if display.LineSize(2) != LineDoubleHeightTop ||
+		display.LineSize(3) != LineDoubleHeightBottom {
+		t.Errorf("DECDHL: got %v, %v", display.LineSize(2), display.LineSize(3))
+	}
+
+	emul.Write([]byte("\x1b[1H\x1b#5\x1b[1;10Hx"))
+	if display.LineSize(0) != LineSingle || display.Lines[0][9].Code != 'x' {
+		t.Errorf("DECSWL: got %v", display.LineSize(0))
+	}
+
+	// Erasing within the line keeps the line size.
+	emul.Write([]byte("\x1b[1H\x1b#6abc\r\x1b[K\x1b[2H\x1b#6\x1b[2;1;2;10$z" +
+		"\x1b[3H\x1b#6\x1b[3;1;3;10${\x1b[4H\x1b#6\x1b[?2K"))
+	for row := 0; row < 4; row++ {
+		if display.LineSize(row) != LineDoubleWidth {
+			t.Errorf("erase reset line %d size to %v",
+				row, display.LineSize(row))
+		}
+	}
+
+	// ED resets the sizes of the completely erased lines.
+	emul.Write([]byte("\x1b[2;3H\x1b[J"))
+	if display.LineSize(1) != LineDoubleWidth ||
+		display.LineSize(2) != LineSingle || display.LineSize(3) != LineSingle {
+		t.Errorf("ED 0: got %v %v %v", display.LineSize(1),
+			display.LineSize(2), display.LineSize(3))
+	}
+	emul.Write([]byte("\x1b[2;1H\x1b[1J"))
+	if display.LineSize(0) != LineSingle ||
+		display.LineSize(1) != LineDoubleWidth {
+		t.Errorf("ED 1: got %v %v", display.LineSize(0), display.LineSize(1))
+	}
+
+	emul.Write([]byte("\x1b[2J"))
+	for row := 0; row < 4; row++ {
+		if display.LineSize(row) != LineSingle {
+			t.Errorf("ED did not reset line %d size", row)
+		}
+	}
+}
@@ -29,7 +29,8 @@ func (p Point) Equal(o Point) bool {
 }
 
 var (
-	zeroPoint = Point{}
+	_         io.Writer = &Emulator{}
+	zeroPoint           = Point{}
 )
 
 // Emulator color codes.
@@ -49,15 +50,132 @@ const (
 	debug = false
 )
 
+// UnderlineStyle defines the character underline styles.
+type UnderlineStyle uint8
+
+// Underline styles.
+const (
+	UnderlineNone UnderlineStyle = iota
+	UnderlineSingle
+	UnderlineDouble
+	UnderlineCurly
+	UnderlineDotted
+	UnderlineDashed
+)
+
+var underlineStyles = map[UnderlineStyle]string{
+	UnderlineNone:   "none",
+	UnderlineSingle: "single",
+	UnderlineDouble: "double",
+	UnderlineCurly:  "curly",
+	UnderlineDotted: "dotted",
+	UnderlineDashed: "dashed",
+}
+
+func (s UnderlineStyle) String() string {
+	name, ok := underlineStyles[s]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{UnderlineStyle %d}", s)
+}
+
+// CursorStyle defines the cursor styles, selected with DECSCUSR.
+type CursorStyle uint8
+
+// Cursor styles.
+const (
+	CursorBlinkingBlock CursorStyle = iota + 1
+	CursorSteadyBlock
+	CursorBlinkingUnderline
+	CursorSteadyUnderline
+	CursorBlinkingBar
+	CursorSteadyBar
+)
+
+var cursorStyles = map[CursorStyle]string{
+	CursorBlinkingBlock:     "blinking-block",
+	CursorSteadyBlock:       "steady-block",
+	CursorBlinkingUnderline: "blinking-underline",
+	CursorSteadyUnderline:   "steady-underline",
+	CursorBlinkingBar:       "blinking-bar",
+	CursorSteadyBar:         "steady-bar",
+}
+
+func (s CursorStyle) String() string {
+	name, ok := cursorStyles[s]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{CursorStyle %d}", s)
+}
+
+// LineSize defines the line width and height attributes.
+type LineSize uint8
+
+// Line sizes.
+const (
+	LineSingle             LineSize = iota // DECSWL - single width
+	LineDoubleWidth                        // DECDWL - double width
+	LineDoubleHeightTop                    // DECDHL - top half
+	LineDoubleHeightBottom                 // DECDHL - bottom half
+)
+
+var lineSizes = map[LineSize]string{
+	LineSingle:             "single",
+	LineDoubleWidth:        "double-width",
+	LineDoubleHeightTop:    "double-height-top",
+	LineDoubleHeightBottom: "double-height-bottom",
+}
+
+func (s LineSize) String() string {
+	name, ok := lineSizes[s]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{LineSize %d}", s)
+}
+
+// DoubleWidth tests if the line size has double width characters.
+func (s LineSize) DoubleWidth() bool {
+	return s != LineSingle
+}
+
 // Char defines the column character and properties in emulator
-// display.
+// display. The Foreground and Background colors are stored as
+// specified by the SGR attributes; renderers must use the Colors
+// function to resolve the colors for drawing.
 type Char struct {
-	Code       rune
-	Foreground color.NRGBA
-	Background color.NRGBA
-	Bold       bool
-	Italic     bool
-	Underline  bool
+	Code rune
+	// Combining holds the combining characters that follow Code in
+	// the grapheme cluster.
+	Combining string
+	// Wide specifies that the character occupies two columns. The
+	// next column holds a Continuation character.
+	Wide bool
+	// Continuation specifies that this column holds the right half
+	// of the wide character on the previous column.
+	Continuation   bool
+	Foreground     color.NRGBA
+	Background     color.NRGBA
+	Bold           bool
+	Dim            bool
+	Italic         bool
+	Underline      bool
+	UnderlineStyle UnderlineStyle
+	// UnderlineColor specifies the underline color. The zero value
+	// specifies that the underline is drawn with the foreground
+	// color.
+	UnderlineColor color.NRGBA
+	Blink          bool
+	RapidBlink     bool
+	Reverse        bool
+	Conceal        bool
+	Strikethrough  bool
+	Overline       bool
+	// Protected specifies that the character is protected from the
+	// selective erase operations (DECSCA).
+	Protected bool
 }
 
 // Clone creates a new character with the argument code. All other
@@ -68,6 +186,35 @@ func (ch Char) Clone(code rune) Char {
 	return result
 }
 
+// Grapheme returns the grapheme cluster of the character.
+func (ch Char) Grapheme() string {
+	if ch.Continuation {
+		return ""
+	}
+	return string(ch.Code) + ch.Combining
+}
+
+// Colors returns the foreground and background colors for drawing
+// the character. The function resolves the reverse video and conceal
+// attributes.
+func (ch Char) Colors() (fg, bg color.NRGBA) {
+	fg = ch.Foreground
+	bg = ch.Background
+	if ch.Reverse {
+		fg, bg = bg, fg
+	}
+	if ch.Conceal {
+		fg = bg
+	}
+	return
+}
+
+// SetUnderline sets the character underline style.
+func (ch *Char) SetUnderline(style UnderlineStyle) {
+	ch.UnderlineStyle = style
+	ch.Underline = style != UnderlineNone
+}
+
 // CharDisplay implements terminal display.
 type CharDisplay interface {
 	// Size returns the display size.
@@ -78,57 +225,176 @@ type CharDisplay interface {
 	DECALN(size Point)
 	// Set sets the character at the specified point.
 	Set(p Point, char Char)
+	// Get returns the character at the specified point.
+	Get(p Point) Char
 	// InsertChars insert count number of characters to the specified
 	// point.
 	InsertChars(size, p Point, count int)
 	// DeleteChars delets count number of characters from the
 	// specified point.
 	DeleteChars(size, p Point, count int)
-	// ScrollUp scrolls the screen up count lines.
-	ScrollUp(top, bottom, count int)
+	// ScrollUp scrolls the region top-bottom, left-right
+	// (inclusively) up count lines.
+	ScrollUp(top, bottom, left, right, count int)
+	// ScrollDown scrolls the region top-bottom, left-right
+	// (inclusively) down count lines.
+	ScrollDown(top, bottom, left, right, count int)
+	// InsertLines inserts count blank lines at the specified row. The
+	// lines from row to bottom (inclusively) are shifted down and
+	// the lines shifted below bottom are discarded. Only the columns
+	// left-right (inclusively) are modified.
+	InsertLines(row, bottom, left, right, count int)
+	// DeleteLines deletes count lines from the specified row. The
+	// lines below row are shifted up until bottom (inclusively) and
+	// blank lines are inserted at the bottom. Only the columns
+	// left-right (inclusively) are modified.
+	DeleteLines(row, bottom, left, right, count int)
+	// ClearScrollback clears the scrollback history.
+	ClearScrollback()
+	// SetWrapped sets the soft wrap flag of the line. The flag
+	// tells that the line continues on the next line.
+	SetWrapped(row int, wrapped bool)
+	// SetLineSize sets the line size attribute.
+	SetLineSize(row int, size LineSize)
+	// LineSize returns the line size attribute.
+	LineSize(row int) LineSize
+	// SwitchScreen selects the alternate (true) or primary (false)
+	// screen buffer.
+	SwitchScreen(alternate bool)
+}
+
+// ContentDisplay is an optional interface for displays that store
+// only a part of their display area, like the unlimited Stringer
+// display. The emulator limits the operations that visit every line
+// or character to the stored content.
+type ContentDisplay interface {
+	// ContentSize returns the size of the stored content. The
+	// characters outside the content are blank.
+	ContentSize() Point
 }
 
 // Emulator implements terminal emulator.
 type Emulator struct {
-	display      CharDisplay
-	Size         Point
-	originMode   bool
-	scrollTop    int
-	scrollBottom int
-	Cursor       Point
-	Default      Char
-	ch           Char
-	overflow     bool
-	overflowCode int
-	state        *state
-	stdout       io.Writer
-	stderr       io.Writer
+	display       CharDisplay
+	Size          Point
+	originMode    bool
+	scrollTop     int
+	scrollBottom  int
+	scrollLeft    int
+	scrollRight   int
+	leftRightMode bool
+	attrRectangle bool
+	Cursor        Point
+	CursorStyle   CursorStyle
+	Default       Char
+	ch            Char
+	charsets      charsets
+	palette       Palette
+	alternate     bool
+	saved         [2]cursorState
+	insertMode    bool
+	newlineMode   bool
+	tabs          []bool
+	tabsDefault   bool
+	overflow      bool
+	autoWrap      bool
+	lastChar      Char
+	lastPos       Point
+	lastValid     bool
+	parser        *Parser
+	seq           sequence
+	dcsHandlers   map[string]DCSHandler
+	dcs           dcsString
+	stringHandler StringHandler
+	stdout        io.Writer
+	stderr        io.Writer
+
+	// C1Controls specifies if Write accepts raw 8-bit C1 control
+	// bytes (0x80-0x9f). When set, C1 bytes that do not continue a
+	// pending UTF-8 sequence are passed to the emulator as control
+	// codes instead of being replaced with U+FFFD.
+	C1Controls bool
+
+	// DeviceAttributes specify the terminal identification in the
+	// Device Attributes replies.
+	DeviceAttributes DeviceAttributes
+}
+
+// cursorState defines the cursor state saved by DECSC and restored
+// by DECRC.
+type cursorState struct {
+	cursor     Point
+	ch         Char
+	originMode bool
+	overflow   bool
+	charsets   charsets
 }
 
 // NewEmulator creates a new terminal emulator.
 func NewEmulator(stdout, stderr io.Writer, display CharDisplay) *Emulator {
 	e := &Emulator{
 		display: display,
-		Default: Char{
-			Foreground: Black,
-			Background: BrightWhite,
-		},
-		state:  stStart,
-		stdout: stdout,
-		stderr: stderr,
+		stdout:  stdout,
+		stderr:  stderr,
+
+		DeviceAttributes: VT220Attributes,
+	}
+	e.parser = NewParser(e)
+	e.dcsHandlers = make(map[string]DCSHandler)
+	for key, handler := range dcsHandlers {
+		e.dcsHandlers[key] = handler
 	}
+	e.SetPalette(DefaultPalette())
 	e.Reset()
 	return e
 }
 
-// Reset resets the emulator to initial state.
+// Reset resets the emulator to its initial state (RIS). The reset
+// clears the primary and alternate screens, homes the cursor, and
+// resets the modes, margins, tab stops, character sets, cursor style,
+// and the saved cursor. The palette is not changed.
 func (e *Emulator) Reset() {
+	e.saved = [2]cursorState{{ch: e.Default}, {ch: e.Default}}
 	e.Size = e.display.Size()
+	e.resetTabStops()
+	e.charsets = charsets{}
+	e.insertMode = false
+	e.newlineMode = false
+	e.autoWrap = true
 	e.originMode = false
 	e.scrollTop = 0
-	e.scrollBottom = e.Size.Y
+	e.scrollBottom = e.Size.Y - 1
+	e.leftRightMode = false
+	e.resetHorizontalMargins()
+	e.attrRectangle = false
+	e.CursorStyle = CursorBlinkingBlock
 	e.ch = e.Default
+	e.parser.Reset()
+	// Clear both the alternate and the primary screen buffers.
+	e.switchScreen(true)
+	e.clear(true, true)
+	e.switchScreen(false)
 	e.clear(true, true)
+	e.moveTo(0, 0)
+}
+
+// SoftReset performs a soft terminal reset (DECSTR). The soft reset
+// resets the modes, margins, character sets, rendition, and the
+// saved cursor as specified for the VT510 but it does not clear the
+// screen or move the cursor.
+func (e *Emulator) SoftReset() {
+	e.insertMode = false
+	e.newlineMode = false
+	e.originMode = false
+	e.autoWrap = false
+	e.overflow = false
+	e.scrollTop = 0
+	e.scrollBottom = e.Size.Y - 1
+	e.resetHorizontalMargins()
+	e.charsets = charsets{}
+	e.ch = e.Default
+	e.saved = [2]cursorState{{ch: e.Default}, {ch: e.Default}}
+	e.lastValid = false
 }
 
 // Resize sets emulator display area.
@@ -140,11 +406,161 @@ func (e *Emulator) Resize(width, height int) {
 	if e.Size.Y > height {
 		e.Size.Y = height
 	}
+	e.resetTabStops()
+	e.resetHorizontalMargins()
+}
+
+func (e *Emulator) resetHorizontalMargins() {
+	e.scrollLeft = 0
+	e.scrollRight = e.Size.X - 1
+}
+
+// setHorizontalMargins sets the left and right margins (DECSLRM). The
+// margins are ignored unless left is smaller than right.
+func (e *Emulator) setHorizontalMargins(left, right int) {
+	if right >= e.Size.X {
+		right = e.Size.X - 1
+	}
+	if left < 0 || left >= right {
+		return
+	}
+	e.scrollLeft = left
+	e.scrollRight = right
+}
+
+// insideMargins tests if the column is inside the left and right
+// margins.
+func (e *Emulator) insideMargins(col int) bool {
+	return col >= e.scrollLeft && col <= e.scrollRight
+}
+
+// rightEdge returns the column after the last column the cursor can
+// move to when wrapping or moving forward from its current position.
+func (e *Emulator) rightEdge() int {
+	width := e.lineWidth(e.Cursor.Y)
+	if e.Cursor.X <= e.scrollRight && e.scrollRight+1 < width {
+		return e.scrollRight + 1
+	}
+	return width
+}
+
+// home moves the cursor to the home position. The home position is
+// the top-left corner of the margins in the origin mode.
+func (e *Emulator) home() {
+	if e.originMode {
+		e.moveTo(e.scrollTop, e.scrollLeft)
+	} else {
+		e.moveTo(0, 0)
+	}
+}
+
+// cursorPosition moves the cursor to the 1-based row and column
+// (CUP, HVP). In the origin mode, the position is relative to the
+// margins and the cursor can't move outside the margins.
+func (e *Emulator) cursorPosition(row, col int) {
+	if !e.originMode {
+		e.moveTo(row-1, col-1)
+		return
+	}
+	row += e.scrollTop
+	if row > e.scrollBottom+1 {
+		row = e.scrollBottom + 1
+	}
+	col += e.scrollLeft
+	if col > e.scrollRight+1 {
+		col = e.scrollRight + 1
+	}
+	e.moveTo(row-1, col-1)
+}
+
+// Palette returns the emulator color palette.
+func (e *Emulator) Palette() Palette {
+	return e.palette
+}
+
+// SetPalette sets the emulator color palette. The default foreground
+// and background colors of the palette are also set to the Default
+// character attributes.
+func (e *Emulator) SetPalette(palette Palette) {
+	e.palette = palette
+	e.Default.Foreground = palette.Foreground
+	e.Default.Background = palette.Background
+}
+
+func (e *Emulator) dynamicColor(code int, spec, st string) {
+	if spec == "?" {
+		var c color.NRGBA
+		switch code {
+		case 10:
+			c = e.palette.Foreground
+		case 11:
+			c = e.palette.Background
+		case 12:
+			c = e.palette.Cursor
+		}
+		e.output("\x1b]%d;%s%s", code, formatColor(c), st)
+		return
+	}
+	c, err := parseColor(spec)
+	if err != nil {
+		e.debug("OSC %d: %s", code, err)
+		return
+	}
+	e.setDynamicColor(code, c)
+}
+
+func (e *Emulator) setDynamicColor(code int, c color.NRGBA) {
+	switch code {
+	case 10:
+		e.palette.Foreground = c
+		e.Default.Foreground = c
+	case 11:
+		e.palette.Background = c
+		e.Default.Background = c
+	case 12:
+		e.palette.Cursor = c
+	}
+}
+
+// AlternateScreen tests if the alternate screen buffer is active.
+func (e *Emulator) AlternateScreen() bool {
+	return e.alternate
+}
+
+func (e *Emulator) switchScreen(alternate bool) {
+	if alternate == e.alternate {
+		return
+	}
+	e.alternate = alternate
+	e.display.SwitchScreen(alternate)
+}
+
+func (e *Emulator) screen() int {
+	if e.alternate {
+		return 1
+	}
+	return 0
 }
 
-func (e *Emulator) setState(state *state) {
-	e.state = state
-	e.state.reset()
+func (e *Emulator) saveCursor() {
+	e.saved[e.screen()] = cursorState{
+		cursor:     e.Cursor,
+		ch:         e.ch,
+		originMode: e.originMode,
+		overflow:   e.overflow,
+		charsets:   e.charsets,
+	}
+}
+
+func (e *Emulator) restoreCursor() {
+	saved := e.saved[e.screen()]
+	e.moveTo(saved.cursor.Y, saved.cursor.X)
+	e.ch = saved.ch
+	e.originMode = saved.originMode
+	e.charsets = saved.charsets
+	if e.Cursor.Equal(saved.cursor) {
+		e.overflow = saved.overflow
+	}
 }
 
 func (e *Emulator) output(format string, a ...interface{}) {
@@ -174,56 +590,136 @@ func (e *Emulator) setWindowTitle(name string) {
 }
 
 func (e *Emulator) clearLine(line, from, to int) {
+	e.eraseLine(line, from, to, false)
+}
+
+// eraseLine clears the columns from-to of the line. The selective
+// erase clears only the characters that are not protected.
+func (e *Emulator) eraseLine(line, from, to int, selective bool) {
+	e.lastValid = false
 	if line < 0 || line >= e.Size.Y {
 		return
 	}
 	if to >= e.Size.X {
 		to = e.Size.X - 1
 	}
-	e.display.Clear(Point{
+	if from > to {
+		return
+	}
+	e.erase(Point{
 		X: from,
 		Y: line,
 	}, Point{
 		X: to,
 		Y: line,
-	})
+	}, selective)
 }
 
 func (e *Emulator) clear(start, end bool) {
+	e.eraseDisplay(start, end, false)
+}
+
+// eraseDisplay clears the display from the beginning to the cursor
+// and from the cursor to the end of the display. The selective erase
+// clears only the characters that are not protected.
+func (e *Emulator) eraseDisplay(start, end, selective bool) {
+	e.lastValid = false
 	if start {
 		if e.Cursor.Y > 0 {
-			e.display.Clear(zeroPoint, Point{
+			e.erase(zeroPoint, Point{
 				X: e.Size.X - 1,
 				Y: e.Cursor.Y - 1,
-			})
+			}, selective)
 		}
-		e.display.Clear(Point{
+		e.erase(Point{
 			X: 0,
 			Y: e.Cursor.Y,
 		}, Point{
 			X: e.Cursor.X,
 			Y: e.Cursor.Y,
-		})
+		}, selective)
 	}
 	if end {
-		e.display.Clear(Point{
+		e.erase(Point{
 			X: e.Cursor.X,
 			Y: e.Cursor.Y,
 		}, Point{
 			X: e.Size.X - 1,
 			Y: e.Cursor.Y,
-		})
-		e.display.Clear(Point{
-			Y: e.Cursor.Y + 1,
-		}, Point{
-			X: e.Size.X - 1,
-			Y: e.Size.Y - 1,
-		})
+		}, selective)
+		if e.Cursor.Y+1 < e.Size.Y {
+			e.erase(Point{
+				Y: e.Cursor.Y + 1,
+			}, Point{
+				X: e.Size.X - 1,
+				Y: e.Size.Y - 1,
+			}, selective)
+		}
+	}
+	// The completely erased lines are reset to single width. The
+	// selective erase keeps the protected characters so its lines
+	// are not completely erased.
+	if selective {
+		return
+	}
+	from := 0
+	to := e.contentSize().Y - 1
+	if !start {
+		from = e.Cursor.Y
+		if e.Cursor.X > 0 {
+			from++
+		}
+	}
+	if !end && e.Cursor.Y <= to {
+		to = e.Cursor.Y
+		if e.Cursor.X < e.Size.X-1 {
+			to--
+		}
+	}
+	for row := from; row <= to; row++ {
+		e.display.SetLineSize(row, LineSingle)
+	}
+}
+
+// contentSize returns the size of the display content. It is the
+// emulator size unless the display implements ContentDisplay.
+func (e *Emulator) contentSize() Point {
+	size := e.Size
+	if cd, ok := e.display.(ContentDisplay); ok {
+		content := cd.ContentSize()
+		if content.X < size.X {
+			size.X = content.X
+		}
+		if content.Y < size.Y {
+			size.Y = content.Y
+		}
+	}
+	return size
+}
+
+// erase clears the display area. The selective erase clears only the
+// characters that are not protected.
+func (e *Emulator) erase(from, to Point, selective bool) {
+	if !selective {
+		e.display.Clear(from, to)
+		return
+	}
+	if rd, ok := e.display.(RectDisplay); ok {
+		rd.SelectiveErase(from, to)
+		return
+	}
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y; p.Y++ {
+		for p.X = from.X; p.X <= to.X; p.X++ {
+			if !e.display.Get(p).Protected {
+				e.display.Clear(p, p)
+			}
+		}
 	}
 }
 
 func (e *Emulator) lf() {
-	if e.Cursor.Y == e.scrollBottom {
+	if e.Cursor.Y == e.scrollBottom && e.insideMargins(e.Cursor.X) {
 		e.scrollUp(1)
 	} else {
 		e.moveTo(e.Cursor.Y+1, e.Cursor.X)
@@ -231,23 +727,41 @@ func (e *Emulator) lf() {
 }
 
 func (e *Emulator) ri() {
-	// XXX scrollDown
-	e.moveTo(e.Cursor.Y-1, e.Cursor.X)
+	if e.Cursor.Y == e.scrollTop && e.insideMargins(e.Cursor.X) {
+		e.scrollDown(1)
+	} else {
+		e.moveTo(e.Cursor.Y-1, e.Cursor.X)
+	}
 }
 
+// cr moves the cursor to the left margin. If the cursor is left of
+// the left margin, it moves to the first column.
 func (e *Emulator) cr() {
-	e.moveTo(e.Cursor.Y, 0)
+	if e.Cursor.X >= e.scrollLeft {
+		e.moveTo(e.Cursor.Y, e.scrollLeft)
+	} else {
+		e.moveTo(e.Cursor.Y, 0)
+	}
 }
 
-func (e *Emulator) moveTo(row, col int) {
-	if col < 0 {
-		col = 0
+// lineWidth returns the number of columns on the line. The double
+// width lines have half of the display columns.
+func (e *Emulator) lineWidth(row int) int {
+	if e.display.LineSize(row).DoubleWidth() && e.Size.X > 1 {
+		return e.Size.X / 2
 	}
-	if col >= e.Size.X {
-		col = e.Size.X - 1
+	return e.Size.X
+}
+
+func (e *Emulator) setLineSize(size LineSize) {
+	e.display.SetLineSize(e.Cursor.Y, size)
+	if size.DoubleWidth() {
+		e.clearLine(e.Cursor.Y, e.lineWidth(e.Cursor.Y), e.Size.X)
 	}
-	e.Cursor.X = col
+	e.moveTo(e.Cursor.Y, e.Cursor.X)
+}
 
+func (e *Emulator) moveTo(row, col int) {
 	if row < 0 {
 		row = 0
 	}
@@ -255,70 +769,196 @@ func (e *Emulator) moveTo(row, col int) {
 		row = e.Size.Y - 1
 	}
 	e.Cursor.Y = row
+
+	width := e.lineWidth(row)
+	if col < 0 {
+		col = 0
+	}
+	if col >= width {
+		col = width - 1
+	}
+	e.Cursor.X = col
 	e.overflow = false
+	e.lastValid = false
 }
 
 func (e *Emulator) scrollUp(count int) {
+	e.lastValid = false
+	if count > e.scrollBottom-e.scrollTop+1 {
+		count = e.scrollBottom - e.scrollTop + 1
+	}
+	if count <= 0 {
+		return
+	}
+	e.display.ScrollUp(e.scrollTop, e.scrollBottom, e.scrollLeft,
+		e.scrollRight, count)
+}
+
+func (e *Emulator) scrollDown(count int) {
+	e.lastValid = false
 	if count > e.scrollBottom-e.scrollTop+1 {
 		count = e.scrollBottom - e.scrollTop + 1
 	}
-	e.display.ScrollUp(e.scrollTop, e.scrollBottom, count)
+	if count <= 0 {
+		return
+	}
+	e.display.ScrollDown(e.scrollTop, e.scrollBottom, e.scrollLeft,
+		e.scrollRight, count)
+}
+
+func (e *Emulator) insertLines(count int) {
+	e.lastValid = false
+	if e.Cursor.Y < e.scrollTop || e.Cursor.Y > e.scrollBottom ||
+		!e.insideMargins(e.Cursor.X) {
+		return
+	}
+	if count > e.scrollBottom-e.Cursor.Y+1 {
+		count = e.scrollBottom - e.Cursor.Y + 1
+	}
+	if count <= 0 {
+		return
+	}
+	e.display.InsertLines(e.Cursor.Y, e.scrollBottom, e.scrollLeft,
+		e.scrollRight, count)
+	e.moveTo(e.Cursor.Y, e.scrollLeft)
+}
+
+func (e *Emulator) deleteLines(count int) {
+	e.lastValid = false
+	if e.Cursor.Y < e.scrollTop || e.Cursor.Y > e.scrollBottom ||
+		!e.insideMargins(e.Cursor.X) {
+		return
+	}
+	if count > e.scrollBottom-e.Cursor.Y+1 {
+		count = e.scrollBottom - e.Cursor.Y + 1
+	}
+	if count <= 0 {
+		return
+	}
+	e.display.DeleteLines(e.Cursor.Y, e.scrollBottom, e.scrollLeft,
+		e.scrollRight, count)
+	e.moveTo(e.Cursor.Y, e.scrollLeft)
 }
 
 func (e *Emulator) insertChar(code int) {
+	code = e.charsets.translate(code)
+	width := RuneWidth(rune(code))
+	if e.lastValid &&
+		(width == 0 || strings.HasSuffix(e.lastChar.Combining, string(zwj))) {
+		// Combining character or a character following zero width
+		// joiner: append to the previous grapheme cluster.
+		e.lastChar.Combining += string(rune(code))
+		e.display.Set(e.lastPos, e.lastChar)
+		return
+	}
+	if width == 0 {
+		width = 1
+	}
 	if e.overflow {
-		if e.overflowCode != ' ' {
+		// The last column flag is set: wrap to the next line.
+		e.display.SetWrapped(e.Cursor.Y, true)
+		e.lf()
+		e.cr()
+	}
+	lineWidth := e.rightEdge()
+	if width == 2 && e.Cursor.X+1 >= lineWidth {
+		// Wide character does not fit on the last column.
+		if e.autoWrap {
+			e.clearLine(e.Cursor.Y, e.Cursor.X, e.Cursor.X)
+			e.display.SetWrapped(e.Cursor.Y, true)
 			e.lf()
 			e.cr()
+		} else {
+			e.moveTo(e.Cursor.Y, e.Cursor.X-1)
+		}
+		lineWidth = e.rightEdge()
+		if e.Cursor.X+1 >= lineWidth {
+			// Line is too narrow for wide characters.
+			return
 		}
-		e.overflow = false
 	}
-	e.display.Set(e.Cursor, e.ch.Clone(rune(code)))
-	if e.Cursor.X+1 >= e.Size.X {
-		e.overflow = true
-		e.overflowCode = code
+	if e.insertMode {
+		e.insertChars(e.Cursor.Y, e.Cursor.X, width)
+	}
+	ch := e.ch.Clone(rune(code))
+	ch.Wide = width == 2
+	e.display.Set(e.Cursor, ch)
+	if ch.Wide {
+		cont := e.ch.Clone(0)
+		cont.Continuation = true
+		e.display.Set(Point{X: e.Cursor.X + 1, Y: e.Cursor.Y}, cont)
+	}
+	pos := e.Cursor
+	if e.Cursor.X+width >= lineWidth {
+		e.moveTo(e.Cursor.Y, lineWidth-1)
+		e.overflow = e.autoWrap
 	} else {
-		e.moveTo(e.Cursor.Y, e.Cursor.X+1)
+		e.moveTo(e.Cursor.Y, e.Cursor.X+width)
 	}
+	e.lastChar = ch
+	e.lastPos = pos
+	e.lastValid = true
 }
 
 func (e *Emulator) insertChars(row, col, count int) {
+	e.lastValid = false
 	if row < 0 {
 		row = 0
 	} else if row >= e.Size.Y {
 		row = e.Size.Y - 1
 	}
+	if !e.insideMargins(col) {
+		return
+	}
+	size := Point{
+		X: e.lineWidth(row),
+		Y: e.Size.Y,
+	}
+	if e.scrollRight+1 < size.X {
+		size.X = e.scrollRight + 1
+	}
 	if col < 0 {
 		col = 0
-	} else if col >= e.Size.X {
+	} else if col >= size.X {
 		return
 	}
-	if col+count >= e.Size.X {
-		e.clearLine(row, col, e.Size.X)
+	if col+count >= size.X {
+		e.clearLine(row, col, size.X-1)
 		return
 	}
-	e.display.InsertChars(e.Size, Point{
+	e.display.InsertChars(size, Point{
 		Y: row,
 		X: col,
 	}, count)
 }
 
 func (e *Emulator) deleteChars(row, col, count int) {
+	e.lastValid = false
 	if row < 0 {
 		row = 0
 	} else if row >= e.Size.Y {
 		row = e.Size.Y - 1
 	}
+	if !e.insideMargins(col) {
+		return
+	}
+	size := Point{
+		X: e.lineWidth(row),
+		Y: e.Size.Y,
+	}
+	if e.scrollRight+1 < size.X {
+		size.X = e.scrollRight + 1
+	}
 	if col < 0 {
 		col = 0
-	} else if col >= e.Size.X {
+	} else if col >= size.X {
 		return
 	}
-	if col+count >= e.Size.X {
-		e.clearLine(row, col, e.Size.X)
+	if col+count >= size.X {
+		e.clearLine(row, col, size.X-1)
 		return
 	}
-	e.display.DeleteChars(e.Size, Point{
+	e.display.DeleteChars(size, Point{
 		Y: row,
 		X: col,
 	}, count)
@@ -327,13 +967,20 @@ func (e *Emulator) deleteChars(row, col, count int) {
 // Input runs the terminal emulation with the next input code.
 func (e *Emulator) Input(code int) {
 	if debug {
-		e.debug("Emulator.Input: %s<-0x%x (%d) '%c'", e.state, code, code, code)
-	}
-	next := e.state.input(e, code)
-	if next != nil {
-		if debug {
-			e.debug("Emulator.Input: %s->%s", e.state, next)
-		}
-		e.setState(next)
+		e.debug("Emulator.Input: %s<-0x%x (%d) '%c'",
+			e.parser.state, code, code, code)
 	}
+	e.parser.Input(code)
+}
+
+// Write implements the io.Writer interface. The input data is decoded
+// as UTF-8. Partial UTF-8 sequences are buffered between calls and
+// malformed input bytes are replaced with U+FFFD.
+func (e *Emulator) Write(p []byte) (int, error) {
+	return e.parser.Write(p)
+}
+
+// AcceptC1 implements the C1Acceptor.AcceptC1 function.
+func (e *Emulator) AcceptC1() bool {
+	return e.C1Controls
 }
@@ -0,0 +1,922 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"bytes"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func newTestEmulator(width, height int) (*Emulator, *Display) {
+	display := NewDisplay(width, height)
+	return NewEmulator(nil, nil, display), display
+}
+
+func lineString(d *Display, row int) string {
+	return charsString(d.Lines[row])
+}
+
+func TestWriteUTF8(t *testing.T) {
+	input := []byte("aä€\U0001f600b")
+
+	for split := 0; split <= len(input); split++ {
+		emul, display := newTestEmulator(10, 1)
+		emul.Write(input[:split])
+		emul.Write(input[split:])
+
+		got := lineString(display, 0)
+		if got != "aä€\U0001f600b    " {
+			t.Errorf("split %d: got %q", split, got)
+		}
+	}
+}
+
+func TestWriteMalformed(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+	emul.Write([]byte{'a', 0xe2, 0x82, 'b', 0xff, 0x9b, 'c'})
+
+	got := lineString(display, 0)
+	if got != "a��b��c   " {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriteC1Controls(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+	emul.C1Controls = true
+	emul.Write([]byte("ab\x9b1Gc"))
+
+	got := lineString(display, 0)
+	if got != "cb        " {
+		t.Errorf("got %q", got)
+	}
+}
+
+var sgrColorTests = []struct {
+	i  string
+	fg color.NRGBA
+	bg color.NRGBA
+}{
+	{
+		i:  "\x1b[31;42mX",
+		fg: Red,
+		bg: Green,
+	},
+	{
+		i:  "\x1b[91;104mX",
+		fg: BrightRed,
+		bg: BrightBlue,
+	},
+	{
+		i:  "\x1b[38;5;196;48;5;232mX",
+		fg: color.NRGBA{0xff, 0x00, 0x00, 0xff},
+		bg: color.NRGBA{0x08, 0x08, 0x08, 0xff},
+	},
+	{
+		i:  "\x1b[38;2;1;2;3;48;2;4;5;6mX",
+		fg: color.NRGBA{1, 2, 3, 0xff},
+		bg: color.NRGBA{4, 5, 6, 0xff},
+	},
+	{
+		i:  "\x1b[38:5:21;48:2::10:20:30mX",
+		fg: color.NRGBA{0x00, 0x00, 0xff, 0xff},
+		bg: color.NRGBA{10, 20, 30, 0xff},
+	},
+	{
+		i:  "\x1b[38:2:7:8:9;1mX",
+		fg: color.NRGBA{7, 8, 9, 0xff},
+		bg: BrightWhite,
+	},
+	{
+		i:  "\x1b[31;42m\x1b[39;49mX",
+		fg: Black,
+		bg: BrightWhite,
+	},
+}
+
+func TestSGRColors(t *testing.T) {
+	for idx, test := range sgrColorTests {
+		emul, display := newTestEmulator(10, 1)
+		emul.Write([]byte(test.i))
+
+		ch := display.Lines[0][0]
+		if ch.Code != 'X' {
+			t.Errorf("test %d: unexpected code %q", idx, ch.Code)
+		}
+		if ch.Foreground != test.fg {
+			t.Errorf("test %d: foreground %v, expected %v",
+				idx, ch.Foreground, test.fg)
+		}
+		if ch.Background != test.bg {
+			t.Errorf("test %d: background %v, expected %v",
+				idx, ch.Background, test.bg)
+		}
+	}
+}
+
+func TestPalette(t *testing.T) {
+	var out bytes.Buffer
+	display := NewDisplay(10, 1)
+	emul := NewEmulator(&out, nil, display)
+
+	palette := DefaultPalette()
+	palette.Colors[1] = color.NRGBA{0x11, 0x22, 0x33, 0xff}
+	palette.Foreground = White
+	emul.SetPalette(palette)
+
+	emul.Write([]byte("\x1b[31mA\x1b[0mB"))
+	if display.Lines[0][0].Foreground != palette.Colors[1] {
+		t.Errorf("SGR 31: got %v", display.Lines[0][0].Foreground)
+	}
+	if display.Lines[0][1].Foreground != White {
+		t.Errorf("SGR 0: got %v", display.Lines[0][1].Foreground)
+	}
+
+	emul.Write([]byte("\x1b]4;1;?\x07\x1b]11;?\x07"))
+	expected := "\x1b]4;1;rgb:1111/2222/3333\x07" +
+		"\x1b]11;rgb:ffff/ffff/ffff\x07"
+	if out.String() != expected {
+		t.Errorf("OSC query: got %q, expected %q", out.String(), expected)
+	}
+
+	emul.Write([]byte("\x1b]4;2;rgb:ff/8/0;3;#123\x07\x1b]10;#abcdef\x07"))
+	p := emul.Palette()
+	if p.Colors[2] != (color.NRGBA{0xff, 0x88, 0x00, 0xff}) {
+		t.Errorf("OSC 4: got %v", p.Colors[2])
+	}
+	if p.Colors[3] != (color.NRGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("OSC 4: got %v", p.Colors[3])
+	}
+	if p.Foreground != (color.NRGBA{0xab, 0xcd, 0xef, 0xff}) {
+		t.Errorf("OSC 10: got %v", p.Foreground)
+	}
+
+	emul.Write([]byte("\x1b]104;2\x07"))
+	if emul.Palette().Colors[2] != Green {
+		t.Errorf("OSC 104: got %v", emul.Palette().Colors[2])
+	}
+	emul.Write([]byte("\x1b]104\x07"))
+	if emul.Palette().Colors[1] != Red {
+		t.Errorf("OSC 104: got %v", emul.Palette().Colors[1])
+	}
+}
+
+func TestDefaultColors(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+	emul.Write([]byte("\x1b]10;#102030\x07\x1b]11;#405060\x07"))
+	emul.Write([]byte("\x1b[31;42m\x1b[0mA\x1b[31;42m\x1b[39;49mB"))
+
+	fg := color.NRGBA{0x10, 0x20, 0x30, 0xff}
+	bg := color.NRGBA{0x40, 0x50, 0x60, 0xff}
+	for x, ch := range display.Lines[0][:2] {
+		if ch.Foreground != fg || ch.Background != bg {
+			t.Errorf("column %d: got %v/%v, expected %v/%v",
+				x, ch.Foreground, ch.Background, fg, bg)
+		}
+	}
+
+	// SGR 0 and SGR 39/49 use the same default colors.
+	emul.Default.Foreground = White
+	emul.Default.Background = Black
+	emul.Write([]byte("\r\x1b[0mA\x1b[31;42m\x1b[39;49mB"))
+	a := display.Lines[0][0]
+	b := display.Lines[0][1]
+	if a.Foreground != b.Foreground || a.Background != b.Background {
+		t.Errorf("SGR 0 %v/%v, SGR 39/49 %v/%v",
+			a.Foreground, a.Background, b.Foreground, b.Background)
+	}
+}
+
+func TestSGRAttributes(t *testing.T) {
+	emul, display := newTestEmulator(10, 1)
+	emul.Write([]byte("\x1b[1;2;3;4:3;5;7;8;9;53;58;5;1mA"))
+	emul.Write([]byte("\x1b[22;23;24;25;28;29;55;59;31mB"))
+	emul.Write([]byte("\x1b[27;21mC"))
+
+	a := display.Lines[0][0]
+	if !a.Bold || !a.Dim || !a.Italic || !a.Underline ||
+		a.UnderlineStyle != UnderlineCurly || !a.Blink || !a.Reverse ||
+		!a.Conceal || !a.Strikethrough || !a.Overline ||
+		a.UnderlineColor != Red {
+		t.Errorf("SGR set: unexpected attributes: %+v", a)
+	}
+	if a.Foreground != Black {
+		t.Errorf("SGR 2 changed foreground: %v", a.Foreground)
+	}
+	fg, bg := a.Colors()
+	if fg != Black || bg != Black {
+		t.Errorf("Colors: got %v/%v", fg, bg)
+	}
+
+	b := display.Lines[0][1]
+	if b.Bold || b.Dim || b.Italic || b.Underline || b.Blink ||
+		!b.Reverse || b.Conceal || b.Strikethrough || b.Overline ||
+		b.UnderlineColor != (color.NRGBA{}) {
+		t.Errorf("SGR reset: unexpected attributes: %+v", b)
+	}
+	fg, bg = b.Colors()
+	if fg != BrightWhite || bg != Red {
+		t.Errorf("Colors: got %v/%v", fg, bg)
+	}
+
+	c := display.Lines[0][2]
+	if c.Reverse || c.UnderlineStyle != UnderlineDouble {
+		t.Errorf("SGR 27/21: unexpected attributes: %+v", c)
+	}
+	fg, bg = c.Colors()
+	if fg != Red || bg != BrightWhite {
+		t.Errorf("Colors: got %v/%v", fg, bg)
+	}
+}
+
+func TestAlternateScreen(t *testing.T) {
+	emul, display := newTestEmulator(4, 2)
+	display.SetScrollbackLimit(10)
+
+	emul.Write([]byte("ab\r\ncd\x1b[1;2H\x1b[31m"))
+	emul.Write([]byte("\x1b[?1049h"))
+	if !emul.AlternateScreen() || !display.Alternate() {
+		t.Fatalf("alternate screen not active")
+	}
+	if lineString(display, 0) != "    " || lineString(display, 1) != "    " {
+		t.Errorf("alternate screen not cleared")
+	}
+	emul.Write([]byte("\x1b[0mxy\r\nz\r\nw\r\nv"))
+	if display.ScrollbackLen() != 0 {
+		t.Errorf("alternate screen pushed lines to scrollback")
+	}
+
+	emul.Write([]byte("\x1b[?1049l"))
+	if emul.AlternateScreen() || display.Alternate() {
+		t.Fatalf("primary screen not active")
+	}
+	if lineString(display, 0) != "ab  " || lineString(display, 1) != "cd  " {
+		t.Errorf("primary screen not restored: %q %q",
+			lineString(display, 0), lineString(display, 1))
+	}
+	if !emul.Cursor.Equal(Point{X: 1, Y: 0}) {
+		t.Errorf("cursor not restored: %v", emul.Cursor)
+	}
+	emul.Write([]byte("q"))
+	if display.Lines[0][1].Foreground != Red {
+		t.Errorf("attributes not restored")
+	}
+
+	emul.Write([]byte("\x1b[?47h"))
+	if lineString(display, 1) != "v   " {
+		t.Errorf("alternate screen contents lost: %q", lineString(display, 1))
+	}
+	emul.Write([]byte("\x1b[?1047l"))
+	emul.Write([]byte("\x1b[?47h"))
+	if lineString(display, 1) != "    " {
+		t.Errorf("DECSET 1047 did not clear alternate screen")
+	}
+}
+
+func TestSaveCursor(t *testing.T) {
+	emul, display := newTestEmulator(4, 4)
+
+	emul.Write([]byte("\x1b[2;4r\x1b[?6h\x1b[2;3H\x1b[1;32m\x1b7"))
+	emul.Write([]byte("\x1b[?6l\x1b[0m\x1b[H\x1b8A"))
+	if display.Lines[2][2].Code != 'A' || !display.Lines[2][2].Bold ||
+		display.Lines[2][2].Foreground != Green {
+		t.Errorf("DECRC: unexpected char %+v", display.Lines[2][2])
+	}
+	emul.Write([]byte("\x1b[HB"))
+	if display.Lines[1][0].Code != 'B' {
+		t.Errorf("DECRC did not restore origin mode")
+	}
+
+	// Pending wrap state.
+	emul.Write([]byte("\x1b[?6l\x1b[1;1HCDEF\x1b7\x1b[3;1H\x1b8G"))
+	if lineString(display, 1) != "G   " {
+		t.Errorf("DECRC did not restore pending wrap: %q",
+			lineString(display, 1))
+	}
+
+	// CSI s and CSI u, separate state for alternate screen.
+	emul.Write([]byte("\x1b[4;2H\x1b[s\x1b[?47h\x1b[1;1H\x1b[s"))
+	emul.Write([]byte("\x1b[?47l\x1b[uH"))
+	if display.Lines[3][1].Code != 'H' {
+		t.Errorf("SCORC: cursor not restored: %v", emul.Cursor)
+	}
+}
+
+func screenLines(d *Display) []string {
+	var result []string
+	for row := range d.Lines {
+		result = append(result, lineString(d, row))
+	}
+	return result
+}
+
+var scrollTests = []struct {
+	i string
+	o []string
+}{
+	{
+		i: "\x1b[2H\x1b[L",
+		o: []string{"a", "", "b", "c", "d"},
+	},
+	{
+		i: "\x1b[2;4r\x1b[3H\x1b[2L",
+		o: []string{"a", "b", "", "", "e"},
+	},
+	{
+		i: "\x1b[2H\x1b[2M",
+		o: []string{"a", "d", "e", "", ""},
+	},
+	{
+		i: "\x1b[2;4r\x1b[2H\x1b[M",
+		o: []string{"a", "c", "d", "", "e"},
+	},
+	{
+		i: "\x1b[2S",
+		o: []string{"c", "d", "e", "", ""},
+	},
+	{
+		i: "\x1b[2;4r\x1b[T",
+		o: []string{"a", "", "b", "c", "e"},
+	},
+	{
+		i: "\x1b[H\x1bM",
+		o: []string{"", "a", "b", "c", "d"},
+	},
+	{
+		i: "\x1b[2;4r\x1b[3H\x1bM\x1bMx",
+		o: []string{"a", "x", "b", "c", "e"},
+	},
+	{ // Inverted scrolling region is ignored
+		i: "\x1b[4;2r\x1b[5H\n\x1b[S\x1b[T\x1b[H\x1bM",
+		o: []string{"", "", "c", "d", "e"},
+	},
+	{ // Single line scrolling region is ignored
+		i: "\x1b[2;4r\x1b[3;3r\x1b[4H\n",
+		o: []string{"a", "c", "d", "", "e"},
+	},
+}
+
+func TestScroll(t *testing.T) {
+	for idx, test := range scrollTests {
+		emul, display := newTestEmulator(1, 5)
+		emul.Write([]byte("a\r\nb\r\nc\r\nd\r\ne"))
+		emul.Write([]byte(test.i))
+
+		lines := screenLines(display)
+		for i, expected := range test.o {
+			if len(expected) == 0 {
+				expected = " "
+			}
+			if lines[i] != expected {
+				t.Errorf("test %d: got %q, expected %q", idx, lines, test.o)
+				break
+			}
+		}
+	}
+}
+
+func TestScrollInvertedRegion(t *testing.T) {
+	emul, display := newTestEmulator(1, 5)
+	emul.Write([]byte("a\r\nb\r\nc\r\nd\r\ne"))
+
+	// Scrolling with an inverted region must not modify the display.
+	emul.scrollTop = 3
+	emul.scrollBottom = 1
+	emul.Write([]byte("\x1b[S\x1b[T\x1b[2H\x1b[L\x1b[M\x1bM"))
+	emul.scrollUp(1)
+	emul.scrollDown(1)
+
+	expected := []string{"a", "b", "c", "d", "e"}
+	lines := screenLines(display)
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("got %q, expected %q", lines, expected)
+		}
+	}
+}
+
+func TestTrimScroll(t *testing.T) {
+	lines, err := Trim("a\r\nb\r\nc\x1b[2H\x1b[L\x1b[3H\x1b[M\x1b[S")
+	if err != nil {
+		t.Fatalf("Trim failed: %s", err)
+	}
+	if len(lines) != 4 || lines[0] != "" || lines[1] != "c" ||
+		lines[2] != "" || lines[3] != "" {
+		t.Errorf("Trim: unexpected result: %q", lines)
+	}
+}
+
+func TestTabStops(t *testing.T) {
+	var out bytes.Buffer
+	display := NewDisplay(30, 1)
+	emul := NewEmulator(&out, nil, display)
+
+	emul.Write([]byte("\ta\tb"))
+	if display.Lines[0][8].Code != 'a' || display.Lines[0][16].Code != 'b' {
+		t.Errorf("default tab stops: %q", lineString(display, 0))
+	}
+
+	emul.Write([]byte("\x1b[3g\r\x1b[3C\x1bH\x1b[10G\x1bH\r\tc\td\te"))
+	if lineString(display, 0) != "   c    ad      b            e" {
+		t.Errorf("HTS: %q", lineString(display, 0))
+	}
+
+	emul.Write([]byte("\x1b[2Z"))
+	if emul.Cursor.X != 3 {
+		t.Errorf("CBT: cursor %v", emul.Cursor)
+	}
+	emul.Write([]byte("\x1b[I"))
+	if emul.Cursor.X != 9 {
+		t.Errorf("CHT: cursor %v", emul.Cursor)
+	}
+	emul.Write([]byte("\x1b[g\x1b[2$w"))
+	if out.String() != "\x1bP2$u4\x1b\\" {
+		t.Errorf("DECTABSR: got %q", out.String())
+	}
+
+	out.Reset()
+	emul.Write([]byte("\x1bc\x1b[2$w"))
+	if out.String() != "\x1bP2$u9/17/25\x1b\\" {
+		t.Errorf("DECTABSR: got %q", out.String())
+	}
+}
+
+func TestInsertNewlineMode(t *testing.T) {
+	var out bytes.Buffer
+	display := NewDisplay(6, 3)
+	emul := NewEmulator(&out, nil, display)
+
+	emul.Write([]byte("abcd\x1b[2G\x1b[4hXY\x1b[4lZ"))
+	if lineString(display, 0) != "aXYZcd" {
+		t.Errorf("IRM: %q", lineString(display, 0))
+	}
+
+	emul.Write([]byte("\x1b[20h\ne\x1b[20l\nf"))
+	if lineString(display, 1) != "e     " || lineString(display, 2) != " f    " {
+		t.Errorf("LNM: %q", screenLines(display))
+	}
+
+	emul.Write([]byte("\x1b[4h\x1b[4$p\x1b[20$p\x1b[?6$p\x1b[?9999$p"))
+	expected := "\x1b[4;1$y\x1b[20;2$y\x1b[?6;2$y\x1b[?9999;0$y"
+	if out.String() != expected {
+		t.Errorf("DECRQM: got %q, expected %q", out.String(), expected)
+	}
+
+	emul.Write([]byte("\x1bc"))
+	if emul.insertMode || emul.newlineMode {
+		t.Errorf("RIS did not reset IRM and LNM")
+	}
+}
+
+func TestAutoWrap(t *testing.T) {
+	emul, display := newTestEmulator(4, 3)
+
+	emul.Write([]byte("abcd"))
+	if !emul.Cursor.Equal(Point{X: 3, Y: 0}) || !emul.overflow {
+		t.Errorf("last column flag not set: %v", emul.Cursor)
+	}
+	emul.Write([]byte(" e"))
+	if lineString(display, 1) != " e  " || !display.Wrapped(0) {
+		t.Errorf("space did not wrap: %q", screenLines(display))
+	}
+	if display.Wrapped(1) {
+		t.Errorf("unexpected wrap flag")
+	}
+
+	emul.Write([]byte("\x1b[1;1Hwxyz\bq"))
+	if lineString(display, 0) != "wxqz" || emul.Cursor.Y != 0 {
+		t.Errorf("BS: %q, %v", screenLines(display), emul.Cursor)
+	}
+	emul.Write([]byte("\x1b[2K"))
+	if display.Wrapped(0) {
+		t.Errorf("EL did not clear wrap flag")
+	}
+
+	emul.Write([]byte("\x1b[?7l\x1b[3;1H12345678"))
+	if lineString(display, 2) != "1238" || emul.Cursor.Y != 2 {
+		t.Errorf("DECAWM off: %q", screenLines(display))
+	}
+	emul.Write([]byte("\x1b[?7h\x1b[3;4H9\r0"))
+	if lineString(display, 2) != "0239" || display.Wrapped(2) {
+		t.Errorf("CR did not clear last column flag: %q",
+			screenLines(display))
+	}
+}
+
+var marginTests = []struct {
+	i string
+	o []string
+}{
+	{ // LF at the bottom margin scrolls the column range
+		i: "\x1b[5H\x1b[2C\n",
+		o: []string{"aghie", "flmnj", "kqrso", "pvwxt", "u   y"},
+	},
+	{ // SU
+		i: "\x1b[S",
+		o: []string{"aghie", "flmnj", "kqrso", "pvwxt", "u   y"},
+	},
+	{ // RI at the top margin
+		i: "\x1b[1;3H\x1bM",
+		o: []string{"a   e", "fbcdj", "kghio", "plmnt", "uqrsy"},
+	},
+	{ // IL
+		i: "\x1b[2;3H\x1b[LZ",
+		o: []string{"abcde", "fZ  j", "kghio", "plmnt", "uqrsy"},
+	},
+	{ // DL
+		i: "\x1b[2;3H\x1b[M",
+		o: []string{"abcde", "flmnj", "kqrso", "pvwxt", "u   y"},
+	},
+	{ // IL outside the margins is ignored
+		i: "\x1b[2;5H\x1b[L",
+		o: []string{"abcde", "fghij", "klmno", "pqrst", "uvwxy"},
+	},
+	{ // ICH
+		i: "\x1b[1;2H\x1b[@",
+		o: []string{"a bce"},
+	},
+	{ // DCH
+		i: "\x1b[1;2H\x1b[P",
+		o: []string{"acd e"},
+	},
+	{ // Wrap at the right margin
+		i: "\x1b[1;2H1234",
+		o: []string{"a123e", "f4hij"},
+	},
+	{ // CR returns to the left margin
+		i: "\x1b[1;4H\rZ",
+		o: []string{"aZcde"},
+	},
+	{ // CR left of the left margin
+		i: "\x1b[2;1H\rZ",
+		o: []string{"abcde", "Zghij"},
+	},
+	{ // CUF and CUB stop at the margins
+		i: "\x1b[1;2H\x1b[9CZ\x1b[9DY",
+		o: []string{"aYcZe"},
+	},
+	{ // CUP in the origin mode
+		i: "\x1b[?6h\x1b[1;1HZ\x1b[2;9HY",
+		o: []string{"aZcde", "fghYj"},
+	},
+	{ // Resetting DECLRMM resets the margins
+		i: "\x1b[?69l\x1b[1;2H\x1b[@",
+		o: []string{"a bcd"},
+	},
+}
+
+func TestMargins(t *testing.T) {
+	for idx, test := range marginTests {
+		emul, display := newTestEmulator(5, 5)
+		emul.Write([]byte("abcde\r\nfghij\r\nklmno\r\npqrst\r\nuvwxy"))
+		emul.Write([]byte("\x1b[?69h\x1b[2;4s"))
+		emul.Write([]byte(test.i))
+
+		lines := screenLines(display)
+		for i, expected := range test.o {
+			if lines[i] != expected {
+				t.Errorf("test %d: got %q, expected %q", idx, lines, test.o)
+				break
+			}
+		}
+	}
+}
+
+func TestMarginsSaveCursor(t *testing.T) {
+	emul, _ := newTestEmulator(5, 5)
+
+	// CSI s is SCOSC when DECLRMM is reset.
+	emul.Write([]byte("\x1b[2;3H\x1b[s\x1b[H\x1b[u"))
+	if !emul.Cursor.Equal(Point{X: 2, Y: 1}) {
+		t.Errorf("SCOSC: cursor %v", emul.Cursor)
+	}
+
+	// DECSLRM homes the cursor.
+	emul.Write([]byte("\x1b[?69h\x1b[2;4s"))
+	if !emul.Cursor.Equal(Point{}) {
+		t.Errorf("DECSLRM: cursor %v", emul.Cursor)
+	}
+	if emul.scrollLeft != 1 || emul.scrollRight != 3 {
+		t.Errorf("DECSLRM: margins %d-%d", emul.scrollLeft, emul.scrollRight)
+	}
+
+	// Invalid margins are ignored.
+	emul.Write([]byte("\x1b[4;2s"))
+	if emul.scrollLeft != 1 || emul.scrollRight != 3 {
+		t.Errorf("DECSLRM: margins %d-%d", emul.scrollLeft, emul.scrollRight)
+	}
+
+	// Empty parameters reset the margins.
+	emul.Write([]byte("\x1b[s"))
+	if emul.scrollLeft != 0 || emul.scrollRight != 4 {
+		t.Errorf("DECSLRM: margins %d-%d", emul.scrollLeft, emul.scrollRight)
+	}
+}
+
+var originModeTests = []struct {
+	i string
+	o Point
+}{
+	{
+		i: "\x1b[2;4r\x1b[?6h\x1b[2;3H",
+		o: Point{X: 2, Y: 2},
+	},
+	{
+		i: "\x1b[2;4r\x1b[?6h\x1b[2;3f",
+		o: Point{X: 2, Y: 2},
+	},
+	{
+		i: "\x1b[2;4r\x1b[?6h\x1b[9;1H",
+		o: Point{X: 0, Y: 3},
+	},
+	{
+		i: "\x1b[2;4r\x1b[?6h\x1b[9;1f",
+		o: Point{X: 0, Y: 3},
+	},
+	{
+		i: "\x1b[2;4r\x1b[?69h\x1b[2;3s\x1b[?6h\x1b[9;9H",
+		o: Point{X: 2, Y: 3},
+	},
+	{
+		i: "\x1b[2;4r\x1b[?69h\x1b[2;3s\x1b[?6h\x1b[9;9f",
+		o: Point{X: 2, Y: 3},
+	},
+	{
+		i: "\x1b[2;4r\x1b[9;9f",
+		o: Point{X: 4, Y: 4},
+	},
+}
+
+func TestOriginMode(t *testing.T) {
+	for idx, test := range originModeTests {
+		emul, _ := newTestEmulator(5, 5)
+		emul.Write([]byte(test.i))
+		if !emul.Cursor.Equal(test.o) {
+			t.Errorf("test %d: cursor %v, expected %v", idx, emul.Cursor, test.o)
+		}
+	}
+}
+
+func TestTrimMargins(t *testing.T) {
+	lines, err := Trim("abcde\r\nfghij\x1b[?69h\x1b[2;4s\x1b[1;2H\x1b[L")
+	if err != nil {
+		t.Fatalf("Trim failed: %s", err)
+	}
+	expected := []string{"a   e", "fbcdj", " ghi"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Trim: got %q, expected %q", lines, expected)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Trim: got %q, expected %q", lines, expected)
+			break
+		}
+	}
+}
+
+var selectiveEraseTests = []struct {
+	i string
+	o []string
+}{
+	{ // DECSEL 0
+		i: "\x1b[1;2H\x1b[?K",
+		o: []string{"aBC  ", "fGHij"},
+	},
+	{ // DECSEL 1
+		i: "\x1b[1;4H\x1b[?1K",
+		o: []string{" BC e", "fGHij"},
+	},
+	{ // DECSEL 2
+		i: "\x1b[2;1H\x1b[?2K",
+		o: []string{"aBCde", " GH  "},
+	},
+	{ // DECSED 0
+		i: "\x1b[1;5H\x1b[?J",
+		o: []string{"aBCd ", " GH  "},
+	},
+	{ // DECSED 1
+		i: "\x1b[2;1H\x1b[?1J",
+		o: []string{" BC  ", " GHij"},
+	},
+	{ // DECSED 2
+		i: "\x1b[?2J",
+		o: []string{" BC  ", " GH  "},
+	},
+	{ // DECSERA
+		i: "\x1b[1;2;2;4${",
+		o: []string{"aBC e", "fGH j"},
+	},
+	{ // Plain EL erases the protected characters
+		i: "\x1b[1;1H\x1b[K",
+		o: []string{"     ", "fGHij"},
+	},
+	{ // Plain ED erases the protected characters
+		i: "\x1b[2J",
+		o: []string{"     ", "     "},
+	},
+}
+
+func TestSelectiveErase(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		for idx, test := range selectiveEraseTests {
+			display := NewDisplay(5, 2)
+			var disp CharDisplay = display
+			if plain {
+				disp = plainDisplay{display}
+			}
+			emul := NewEmulator(nil, nil, disp)
+			emul.Write([]byte("a\x1b[1\"qBC\x1b[0\"qde\r\n"))
+			emul.Write([]byte("f\x1b[1\"q\x1b[1;0mGH\x1b[2\"qij"))
+			emul.Write([]byte(test.i))
+
+			lines := screenLines(display)
+			for i, expected := range test.o {
+				if lines[i] != expected {
+					t.Errorf("test %d (plain=%v): got %q, expected %q",
+						idx, plain, lines, test.o)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestProtectedSaveCursor(t *testing.T) {
+	emul, _ := newTestEmulator(5, 2)
+	emul.Write([]byte("\x1b[1\"q\x1b7\x1b[0\"q"))
+	if emul.ch.Protected {
+		t.Errorf("DECSCA 0 did not reset protection")
+	}
+	emul.Write([]byte("\x1b8"))
+	if !emul.ch.Protected {
+		t.Errorf("DECRC did not restore protection")
+	}
+	emul.Write([]byte("\x1bc"))
+	if emul.ch.Protected {
+		t.Errorf("RIS did not reset protection")
+	}
+}
+
+func TestReset(t *testing.T) {
+	emul, display := newTestEmulator(20, 4)
+	emul.Write([]byte("\x1b[3g\x1b[4h\x1b[20h\x1b[?7l\x1b[2;3r\x1b[?6h"))
+	emul.Write([]byte("\x1b[?69h\x1b[2;4s\x1b)0\x0e\x1b[1m\x1b[3;3H\x1b7"))
+	emul.Write([]byte("\x1b[?1049habc\x1bc"))
+
+	if emul.AlternateScreen() {
+		t.Errorf("RIS: alternate screen active")
+	}
+	if !emul.Cursor.Equal(Point{}) {
+		t.Errorf("RIS: cursor %v", emul.Cursor)
+	}
+	if emul.insertMode || emul.newlineMode || !emul.autoWrap ||
+		emul.originMode || emul.leftRightMode {
+		t.Errorf("RIS: modes not reset")
+	}
+	if emul.scrollTop != 0 || emul.scrollBottom != 3 ||
+		emul.scrollLeft != 0 || emul.scrollRight != 19 {
+		t.Errorf("RIS: margins not reset")
+	}
+	if emul.nextTabStop(0) != 8 {
+		t.Errorf("RIS: tab stops not reset")
+	}
+	if emul.ch.Bold {
+		t.Errorf("RIS: rendition not reset")
+	}
+	emul.Write([]byte("q\x1b8x"))
+	if strings.TrimRight(lineString(display, 0), " ") != "x" {
+		t.Errorf("RIS: charsets or saved cursor not reset: %q",
+			screenLines(display))
+	}
+}
+
+func TestResetAlternateScreen(t *testing.T) {
+	emul, display := newTestEmulator(10, 2)
+	emul.Write([]byte("abc\x1b[?47h\x1b[Hxyz\x1bc"))
+	if line := strings.TrimRight(lineString(display, 0), " "); line != "" {
+		t.Errorf("RIS: primary screen not cleared: %q", line)
+	}
+	emul.Write([]byte("\x1b[?47h"))
+	if line := strings.TrimRight(lineString(display, 0), " "); line != "" {
+		t.Errorf("RIS: alternate screen not cleared: %q", line)
+	}
+}
+
+func TestSoftReset(t *testing.T) {
+	emul, display := newTestEmulator(20, 4)
+	emul.Write([]byte("abc\x1b[3g\x1b[4h\x1b[20h\x1b[2;3r\x1b[?6h"))
+	emul.Write([]byte("\x1b[?69h\x1b[2;4s"))
+	emul.Write([]byte("\x1b)0\x0e\x1b[1;1\"q\x1b[2;3H\x1b7\x1b[!p"))
+
+	if strings.TrimRight(lineString(display, 0), " ") != "abc" {
+		t.Errorf("DECSTR cleared the screen: %q", screenLines(display))
+	}
+	if !emul.Cursor.Equal(Point{X: 3, Y: 2}) {
+		t.Errorf("DECSTR moved the cursor: %v", emul.Cursor)
+	}
+	if emul.insertMode || emul.newlineMode || emul.autoWrap ||
+		emul.originMode {
+		t.Errorf("DECSTR: modes not reset")
+	}
+	if emul.scrollTop != 0 || emul.scrollBottom != 3 ||
+		emul.scrollLeft != 0 || emul.scrollRight != 19 {
+		t.Errorf("DECSTR: margins not reset")
+	}
+	if emul.ch.Bold || emul.ch.Protected {
+		t.Errorf("DECSTR: rendition not reset")
+	}
+	if emul.nextTabStop(0) != 19 {
+		t.Errorf("DECSTR reset tab stops")
+	}
+	emul.Write([]byte("\x1b8q"))
+	if strings.TrimRight(lineString(display, 0), " ") != "qbc" {
+		t.Errorf("DECSTR: charsets or saved cursor not reset: %q",
+			screenLines(display))
+	}
+
+	emul.Write([]byte("\x1b[?7h\x1b[4h\x1b[20h"))
+	emul.SoftReset()
+	if emul.insertMode || emul.newlineMode || emul.autoWrap {
+		t.Errorf("SoftReset: modes not reset")
+	}
+}
+
+func TestVT52(t *testing.T) {
+	var out bytes.Buffer
+	display := NewDisplay(10, 4)
+	emul := NewEmulator(&out, nil, display)
+
+	emul.Write([]byte("\x1b[?2$p\x1b[?2l"))
+	emul.Write([]byte("abc\x1bY\x22\x24X\x1bAY\x1bD\x1bDZ\x1bB\x1bCW"))
+	expected := []string{
+		"abc       ",
+		"    ZY    ",
+		"    X W   ",
+		"          ",
+	}
+	for i, line := range screenLines(display) {
+		if line != expected[i] {
+			t.Fatalf("VT52 cursor: got %q, expected %q",
+				screenLines(display), expected)
+		}
+	}
+
+	// Out of range row keeps the current line.
+	emul.Write([]byte("\x1bY~\x21"))
+	if !emul.Cursor.Equal(Point{X: 1, Y: 2}) {
+		t.Errorf("VT52 ESC Y: cursor %v", emul.Cursor)
+	}
+
+	// Reverse line feed at the top scrolls down.
+	emul.Write([]byte("\x1bH\x1bFq\x1bGq\x1bI"))
+	expected = []string{
+		"          ",
+		"─qc       ",
+		"    ZY    ",
+		"    X W   ",
+	}
+	for i, line := range screenLines(display) {
+		if line != expected[i] {
+			t.Fatalf("VT52 graphics: got %q, expected %q",
+				screenLines(display), expected)
+		}
+	}
+
+	emul.Write([]byte("\x1bY\x22\x25\x1bK\x1bY\x23\x20\x1bJ\x1bZ"))
+	expected = []string{
+		"          ",
+		"─qc       ",
+		"    Z     ",
+		"          ",
+	}
+	for i, line := range screenLines(display) {
+		if line != expected[i] {
+			t.Fatalf("VT52 erase: got %q, expected %q",
+				screenLines(display), expected)
+		}
+	}
+
+	// CSI sequences are recognized after returning to the ANSI mode.
+	emul.Write([]byte("\x1b<\x1b[?2$p"))
+	if out.String() != "\x1b[?2;1$y\x1b/Z\x1b[?2;1$y" {
+		t.Errorf("VT52 reports: %q", out.String())
+	}
+}
+
+func TestVT52AddressRows(t *testing.T) {
+	emul, _ := newTestEmulator(80, 40)
+	emul.Write([]byte("\x1b[?2l"))
+	// Rows 28-31 are addressed with the private marker bytes 0x3c-0x3f.
+	for row := 28; row <= 31; row++ {
+		emul.Write([]byte{0x1b, 'Y', byte(0x20 + row), byte(0x20 + row)})
+		if !emul.Cursor.Equal(Point{X: row, Y: row}) {
+			t.Errorf("VT52 ESC Y row %d: cursor %v", row, emul.Cursor)
+		}
+	}
+}
@@ -9,152 +9,509 @@
 package vt100
 
 import (
-	"regexp"
+	"fmt"
 	"strconv"
 	"strings"
 )
 
-type action func(e *Emulator, state *state, ch int)
+// Print implements the Handler.Print function.
+func (e *Emulator) Print(r rune) {
+	e.insertChar(int(r))
+}
 
-func actError(e *Emulator, state *state, ch int) {
-	e.debug("actError: state=%s, ch=0x%x (%d) '%c'", state, ch, ch, ch)
-	e.setState(stStart)
+// Execute implements the Handler.Execute function. The 8-bit C1
+// controls are mapped to their 7-bit ESC Fe equivalents.
+func (e *Emulator) Execute(code byte) {
+	if code < 0x20 {
+		actC0Control(e, int(code))
+	} else {
+		actC1Control(e, int(code)-0x40)
+	}
 }
 
-func actInsertChar(e *Emulator, state *state, ch int) {
-	e.insertChar(ch)
+// ESCDispatch implements the Handler.ESCDispatch function.
+func (e *Emulator) ESCDispatch(intermediates []byte, final byte) {
+	if e.parser.VT52() {
+		// The VT52 sequences have no private markers and the direct
+		// cursor address bytes can be in the private marker range.
+		e.seq = sequence{
+			intermediates: string(intermediates),
+		}
+		actVT52Escape(e, &e.seq, int(final))
+	} else {
+		actESCFinal(e, e.sequence(nil, intermediates), int(final))
+	}
 }
 
-func actInsertSpace(e *Emulator, state *state, ch int) {
-	e.insertChar(' ')
+// CSIDispatch implements the Handler.CSIDispatch function.
+func (e *Emulator) CSIDispatch(params *Params, intermediates []byte,
+	final byte) {
+	actCSI(e, e.sequence(params, intermediates), int(final))
 }
 
-func actC0Control(e *Emulator, state *state, ch int) {
-	switch ch {
-	case 0x08: // BS
-		if e.overflow {
-			e.overflow = false
+// OSCDispatch implements the Handler.OSCDispatch function.
+func (e *Emulator) OSCDispatch(data []byte, bell bool) {
+	actOSC(e, string(data), bell)
+}
+
+// DCSHook implements the Handler.DCSHook function.
+func (e *Emulator) DCSHook(params *Params, intermediates []byte,
+	final byte) {
+	e.dcs.handler = e.dcsHandlers[string(intermediates)+string(rune(final))]
+	if e.dcs.handler == nil {
+		e.debug("unsupported DCS %s%c",
+			e.sequence(params, intermediates), final)
+		return
+	}
+	e.dcs.params = *params
+	e.dcs.data = e.dcs.data[:0]
+	e.dcs.full = false
+}
+
+// DCSPut implements the Handler.DCSPut function.
+func (e *Emulator) DCSPut(r rune) {
+	if e.dcs.handler != nil {
+		e.dcs.put(r)
+	}
+}
+
+// DCSUnhook implements the Handler.DCSUnhook function.
+func (e *Emulator) DCSUnhook(cancel bool) {
+	handler := e.dcs.handler
+	e.dcs.handler = nil
+	if handler == nil || cancel {
+		return
+	}
+	if e.dcs.full {
+		e.debug("DCS string too long")
+		return
+	}
+	handler(e, &e.dcs.params, e.dcs.data)
+}
+
+// StringDispatch implements the Handler.StringDispatch function.
+func (e *Emulator) StringDispatch(kind StringKind, data []byte) {
+	if e.stringHandler == nil {
+		e.debug("unsupported %s %q", kind, data)
+		return
+	}
+	e.stringHandler(e, kind, data)
+}
+
+// sequence returns the control sequence for the parser event. The
+// leading private markers of the intermediates are split into the
+// sequence prefix. The returned value is valid until the next call of
+// sequence.
+func (e *Emulator) sequence(params *Params, intermediates []byte) *sequence {
+	var i int
+	for i < len(intermediates) &&
+		intermediates[i] >= 0x3c && intermediates[i] <= 0x3f {
+		i++
+	}
+	e.seq.prefix = string(intermediates[:i])
+	e.seq.intermediates = string(intermediates[i:])
+	if params != nil {
+		e.seq.params = params.values[:params.n]
+		e.seq.sub = params.sub[:params.n]
+	} else {
+		e.seq.params = nil
+		e.seq.sub = nil
+	}
+	return &e.seq
+}
+
+// sequence holds the private marker, parameters, and intermediates
+// of a control sequence.
+type sequence struct {
+	prefix        string
+	intermediates string
+	params        []int
+	// sub specifies the parameters that are colon separated
+	// sub-parameters of their preceding parameter.
+	sub []bool
+}
+
+func (s *sequence) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.prefix)
+	for i, v := range s.params {
+		if i > 0 {
+			if s.sub[i] {
+				sb.WriteByte(':')
+			} else {
+				sb.WriteByte(';')
+			}
+		}
+		fmt.Fprintf(&sb, "%d", v)
+	}
+	sb.WriteString(s.intermediates)
+	return sb.String()
+}
+
+// empty tests if the sequence has no private marker, parameters, or
+// intermediates.
+func (s *sequence) empty() bool {
+	return len(s.prefix) == 0 && len(s.params) == 0 &&
+		len(s.intermediates) == 0
+}
+
+func (s *sequence) csiParam(a int) int {
+	_, values := s.parseCSIParam([]int{a})
+	return values[0]
+}
+
+func (s *sequence) csiPrefixParam(a int) (string, int) {
+	prefix, values := s.parseCSIParam([]int{a})
+	return prefix, values[0]
+}
+
+func (s *sequence) csiParams(a, b int) (string, int, int) {
+	prefix, values := s.parseCSIParam([]int{a, b})
+	return prefix, values[0], values[1]
+}
+
+// csiIntermediate returns the CSI intermediate bytes.
+func (s *sequence) csiIntermediate() string {
+	return s.intermediates
+}
+
+// parseCSIParam returns the private marker and the parameter values.
+// The missing and zero values are replaced with the defaults. The
+// sub-parameters are skipped.
+func (s *sequence) parseCSIParam(defaults []int) (string, []int) {
+	var idx int
+	for i, v := range s.params {
+		if s.sub[i] {
+			continue
+		}
+		if v == 0 && idx < len(defaults) {
+			v = defaults[idx]
+		}
+		if idx < len(defaults) {
+			defaults[idx] = v
 		} else {
-			e.moveTo(e.Cursor.Y, e.Cursor.X-1)
+			defaults = append(defaults, v)
 		}
-	case 0x09: // Horizontal Tabulation.
-		var x = e.Cursor.X + 1
-		for ; x%8 != 0; x++ {
+		idx++
+	}
+	return s.prefix, defaults
+}
+
+// parseCSISubParams parses the CSI parameters with their colon
+// separated sub-parameters. Each parameter is returned as a slice
+// where the first element is the parameter value and the remaining
+// elements are its sub-parameters. Empty values are returned as 0.
+func (s *sequence) parseCSISubParams() (string, [][]int) {
+	if len(s.params) == 0 {
+		return s.prefix, [][]int{{0}}
+	}
+	var result [][]int
+	for i, v := range s.params {
+		if s.sub[i] && len(result) > 0 {
+			result[len(result)-1] = append(result[len(result)-1], v)
+		} else {
+			result = append(result, []int{v})
 		}
-		e.moveTo(e.Cursor.Y, x)
+	}
+	return s.prefix, result
+}
+
+func actC0Control(e *Emulator, ch int) {
+	switch ch {
+	case 0x08: // BS
+		e.moveTo(e.Cursor.Y, e.Cursor.X-1)
+	case 0x09: // Horizontal Tabulation.
+		e.moveTo(e.Cursor.Y, e.nextTabStop(e.Cursor.X))
 
 	case 0x0a: // Linefeed, move to same position on next line (see also NL)
 		e.lf()
+		if e.newlineMode {
+			e.cr()
+		}
 
 	case 0x0b: // Vertical Tabulation, move to next predetermined line
 		e.lf()
+		if e.newlineMode {
+			e.cr()
+		}
+
+	case 0x0c: // Form Feed, processed as LF
+		e.lf()
+		if e.newlineMode {
+			e.cr()
+		}
 
 	case 0x0d: // Carriage Return
 		e.cr()
 
+	case 0x0e: // Shift Out, invoke G1 character set into GL
+		e.charsets.gl = 1
+
+	case 0x0f: // Shift In, invoke G0 character set into GL
+		e.charsets.gl = 0
+
 	default:
-		e.debug("actC0Control: %s: 0x%x", state, ch)
+		e.debug("actC0Control: 0x%x", ch)
 	}
 }
 
-func actC1Control(e *Emulator, state *state, ch int) {
+func actC1Control(e *Emulator, ch int) {
 	switch ch {
 	case 'D': // Index, moves down one line same column regardless of NL
 		e.lf()
 	case 'E': // NEw Line, moves done one line and to first column (CR+LF)
 		e.lf()
 		e.cr()
+	case 'H': // Horizontal Tab Set, set tab stop at current column
+		e.setTabStop(e.Cursor.X, true)
 	case 'M': // Reverse Index, go up one line, reverse scroll if necessary
 		e.ri()
+	case 'N': // Single Shift 2, use G2 for the next character
+		e.charsets.singleShift = 2
+	case 'O': // Single Shift 3, use G3 for the next character
+		e.charsets.singleShift = 3
+	case '\\': // String Terminator, ignored outside control strings
 	default:
-		e.debug("actC1Control: %s: %s0x%x", state, string(state.parameters), ch)
+		e.debug("actC1Control: 0x%x", ch)
 	}
 }
 
-func actTwoCharEscape(e *Emulator, state *state, ch int) {
+func actTwoCharEscape(e *Emulator, seq *sequence, ch int) {
 	switch ch {
 	case 'c': // RIS - Reset to Initial State (VT100 does a power-on reset)
 		e.Reset()
 
+	case 'n': // LS2 - Locking Shift 2, invoke G2 character set into GL
+		e.charsets.gl = 2
+
+	case 'o': // LS3 - Locking Shift 3, invoke G3 character set into GL
+		e.charsets.gl = 3
+
 	default:
-		e.debug("actTwoCharEscape: %s: %s0x%x",
-			state, string(state.parameters), ch)
+		e.debug("actTwoCharEscape: %s0x%x", seq, ch)
 	}
 }
 
-func actAppendParam(e *Emulator, state *state, ch int) {
-	state.parameters = append(state.parameters, rune(ch))
+// actESCFinal dispatches the escape sequences by their intermediate
+// and final characters.
+func actESCFinal(e *Emulator, seq *sequence, ch int) {
+	if len(seq.intermediates) > 0 {
+		switch seq.intermediates[0] {
+		case '(', ')', '*', '+':
+			actDesignate(e, seq, ch)
+			return
+		}
+	}
+	switch {
+	case ch < 0x40:
+		actPrivateFunction(e, seq, ch)
+	case ch < 0x60:
+		actC1Control(e, ch)
+	default:
+		actTwoCharEscape(e, seq, ch)
+	}
 }
 
-func actPrivateFunction(e *Emulator, state *state, ch int) {
+// actDesignate handles the Select Character Set (SCS) sequences.
+func actDesignate(e *Emulator, seq *sequence, ch int) {
+	if len(seq.intermediates) != 1 {
+		e.debug("unsupported SCS: ESC %s%c", seq, ch)
+		return
+	}
+	cs, ok := charsetFinals[ch]
+	if !ok {
+		e.debug("unsupported SCS: ESC %s%c", seq, ch)
+		return
+	}
+	e.charsets.designate(seq.intermediates[0], cs)
+}
+
+func actPrivateFunction(e *Emulator, seq *sequence, ch int) {
 	switch ch {
+	case '7':
+		switch seq.intermediates {
+		case "": // DECSC - Save cursor
+			e.saveCursor()
+
+		default:
+			e.debug("unsupported actPrivateFunction: %s%c",
+				seq, ch)
+		}
+
+	case '3', '4', '5', '6':
+		if seq.intermediates != "#" {
+			e.debug("unsupported actPrivateFunction: %s%c",
+				seq, ch)
+			break
+		}
+		switch ch {
+		case '3': // DECDHL - Double-height line, top half
+			e.setLineSize(LineDoubleHeightTop)
+		case '4': // DECDHL - Double-height line, bottom half
+			e.setLineSize(LineDoubleHeightBottom)
+		case '5': // DECSWL - Single-width line
+			e.setLineSize(LineSingle)
+		case '6': // DECDWL - Double-width line
+			e.setLineSize(LineDoubleWidth)
+		}
+
 	case '8':
-		switch string(state.parameters) {
+		switch seq.intermediates {
+		case "": // DECRC - Restore cursor
+			e.restoreCursor()
+
 		case "#": // DECALN - Alignment display, fill screen with "E"
 			e.display.DECALN(e.Size)
 
 		default:
 			e.debug("unsupported actPrivateFunction: %s%c",
-				string(state.parameters), ch)
+				seq, ch)
 		}
 
 	default:
 		e.debug("unsupported actPrivateFunction: %s%c",
-			string(state.parameters), ch)
+			seq, ch)
 	}
 }
 
-func actOSC(e *Emulator, state *state, ch int) {
-	params := state.params()
-	if len(params) != 2 {
+func actOSC(e *Emulator, data string, bell bool) {
+	params := strings.Split(data, ";")
+	if len(params) < 2 && params[0] != "104" && params[0] != "110" &&
+		params[0] != "111" && params[0] != "112" {
 		e.debug("OSC: invalid parameters: %v", params)
 		return
 	}
+	// Replies are terminated with the terminator of the request.
+	st := "\x1b\\"
+	if bell {
+		st = "\x07"
+	}
+
 	switch params[0] {
 	case "0":
-		e.setIconName(params[1])
-		e.setWindowTitle(params[1])
+		e.setIconName(strings.Join(params[1:], ";"))
+		e.setWindowTitle(strings.Join(params[1:], ";"))
 
 	case "1":
-		e.setIconName(params[1])
+		e.setIconName(strings.Join(params[1:], ";"))
 
 	case "2":
-		e.setWindowTitle(params[1])
+		e.setWindowTitle(strings.Join(params[1:], ";"))
+
+	case "4": // Change color number c to the color specified by spec
+		for i := 1; i+1 < len(params); i += 2 {
+			c, err := strconv.Atoi(params[i])
+			if err != nil || c < 0 || c >= len(e.palette.Colors) {
+				e.debug("OSC 4: invalid color number: %s", params[i])
+				continue
+			}
+			if params[i+1] == "?" {
+				e.output("\x1b]4;%d;%s%s",
+					c, formatColor(e.palette.Colors[c]), st)
+				continue
+			}
+			color, err := parseColor(params[i+1])
+			if err != nil {
+				e.debug("OSC 4: %s", err)
+				continue
+			}
+			e.palette.Colors[c] = color
+		}
+
+	case "10", "11", "12": // Change dynamic colors
+		// Each parameter sets the next dynamic color.
+		code, _ := strconv.Atoi(params[0])
+		for _, spec := range params[1:] {
+			if code > 12 {
+				break
+			}
+			e.dynamicColor(code, spec, st)
+			code++
+		}
+
+	case "104": // Reset color number c
+		def := DefaultPalette()
+		if len(params) == 1 || (len(params) == 2 && len(params[1]) == 0) {
+			e.palette.Colors = def.Colors
+			break
+		}
+		for _, param := range params[1:] {
+			c, err := strconv.Atoi(param)
+			if err != nil || c < 0 || c >= len(e.palette.Colors) {
+				e.debug("OSC 104: invalid color number: %s", param)
+				continue
+			}
+			e.palette.Colors[c] = def.Colors[c]
+		}
+
+	case "110": // Reset foreground color
+		e.setDynamicColor(10, DefaultPalette().Foreground)
+
+	case "111": // Reset background color
+		e.setDynamicColor(11, DefaultPalette().Background)
+
+	case "112": // Reset cursor color
+		e.setDynamicColor(12, DefaultPalette().Cursor)
 
 	default:
 		e.debug("OSC: unsupported control: %v", params)
 	}
 }
 
-func actCSI(e *Emulator, state *state, ch int) {
+func actCSI(e *Emulator, seq *sequence, ch int) {
 	if debug {
-		e.debug("actCSI: ESC[%s%c (0x%x)", string(state.parameters), ch, ch)
+		e.debug("actCSI: ESC[%s%c (0x%x)", seq, ch, ch)
+	}
+	if len(seq.csiIntermediate()) > 0 {
+		actCSIIntermediate(e, seq, ch)
+		return
 	}
 	switch ch {
 	case '@': // ICH - Insert CHaracter
-		e.insertChars(e.Cursor.Y, e.Cursor.X, state.csiParam(1))
+		e.insertChars(e.Cursor.Y, e.Cursor.X, seq.csiParam(1))
 
 	case 'A': // CUU - CUrsor Up
-		e.moveTo(e.Cursor.Y-state.csiParam(1), e.Cursor.X)
+		e.moveTo(e.Cursor.Y-seq.csiParam(1), e.Cursor.X)
 
 	case 'B': // CUD - CUrsor Down
-		row := e.Cursor.Y + state.csiParam(1)
+		row := e.Cursor.Y + seq.csiParam(1)
 		if row >= e.Size.Y {
 			row = e.Size.Y - 1
 		}
 		e.moveTo(row, e.Cursor.X)
 
-	case 'C': // CUF - CUrsor Forward
-		e.moveTo(e.Cursor.Y, e.Cursor.X+state.csiParam(1))
+	case 'C': // CUF - CUrsor Forward, stops at the right margin
+		col := e.Cursor.X + seq.csiParam(1)
+		if e.Cursor.X <= e.scrollRight && col > e.scrollRight {
+			col = e.scrollRight
+		}
+		e.moveTo(e.Cursor.Y, col)
 
-	case 'D': // CUB - CUrsor Backward
-		e.moveTo(e.Cursor.Y, e.Cursor.X-state.csiParam(1))
+	case 'D': // CUB - CUrsor Backward, stops at the left margin
+		col := e.Cursor.X - seq.csiParam(1)
+		if e.Cursor.X >= e.scrollLeft && col < e.scrollLeft {
+			col = e.scrollLeft
+		}
+		e.moveTo(e.Cursor.Y, col)
 
 	case 'G': // CHA - Cursor Horizontal position Absolute
-		e.moveTo(e.Cursor.Y, state.csiParam(1)-1)
+		e.moveTo(e.Cursor.Y, seq.csiParam(1)-1)
 
 	case 'K': // EL  - Erase in Line (cursor does not move)
-		switch state.csiParam(0) {
+		prefix, mode := seq.csiPrefixParam(0)
+		if prefix == "?" {
+			// DECSEL - Selective Erase in Line
+			switch mode {
+			case 0:
+				e.eraseLine(e.Cursor.Y, e.Cursor.X, e.Size.X, true)
+			case 1:
+				e.eraseLine(e.Cursor.Y, 0, e.Cursor.X, true)
+			case 2:
+				e.eraseLine(e.Cursor.Y, 0, e.Size.X, true)
+			}
+			break
+		}
+		switch mode {
 		case 0:
 			e.clearLine(e.Cursor.Y, e.Cursor.X, e.Size.X)
 		case 1:
@@ -163,46 +520,111 @@ func actCSI(e *Emulator, state *state, ch int) {
 			e.clearLine(e.Cursor.Y, 0, e.Size.X)
 		}
 
-	case 'P':
-		e.deleteChars(e.Cursor.Y, e.Cursor.X, state.csiParam(1))
+	case 'L': // IL - Insert Line
+		e.insertLines(seq.csiParam(1))
+
+	case 'M': // DL - Delete Line
+		e.deleteLines(seq.csiParam(1))
+
+	case 'P': // DCH - Delete CHaracter
+		e.deleteChars(e.Cursor.Y, e.Cursor.X, seq.csiParam(1))
 
 	case 'H': // CUP - CUrsor Position
-		_, row, col := state.csiParams(1, 1)
-		if e.originMode {
-			e.moveTo(e.scrollTop+row-1, col-1)
+		_, row, col := seq.csiParams(1, 1)
+		e.cursorPosition(row, col)
+
+	case 'I': // CHT - Cursor Horizontal Tabulation
+		x := e.Cursor.X
+		for i := seq.csiParam(1); i > 0; i-- {
+			x = e.nextTabStop(x)
+		}
+		e.moveTo(e.Cursor.Y, x)
+
+	case 'Z': // CBT - Cursor Backward Tabulation
+		x := e.Cursor.X
+		for i := seq.csiParam(1); i > 0; i-- {
+			x = e.prevTabStop(x)
+		}
+		e.moveTo(e.Cursor.Y, x)
+
+	case 'W':
+		prefix, mode := seq.csiPrefixParam(0)
+		if prefix == "?" && mode == 5 { // DECST8C - Set Tab at every 8 columns
+			e.resetTabStops()
 		} else {
-			e.moveTo(row-1, col-1)
+			e.debug("unsupported ESC[%sW", seq)
+		}
+
+	case 'g': // TBC - Tabulation Clear
+		switch seq.csiParam(0) {
+		case 0: // Clear tab stop at current column
+			e.setTabStop(e.Cursor.X, false)
+		case 3: // Clear all tab stops
+			e.clearTabStops()
 		}
 
 	case 'J': // Erase in Display (cursor does not move)
-		switch state.csiParam(0) {
+		prefix, mode := seq.csiPrefixParam(0)
+		if prefix == "?" {
+			// DECSED - Selective Erase in Display
+			switch mode {
+			case 0:
+				e.eraseDisplay(false, true, true)
+			case 1:
+				e.eraseDisplay(true, false, true)
+			case 2:
+				e.eraseDisplay(true, true, true)
+			}
+			break
+		}
+		switch mode {
 		case 0: // Erase from current position to end (inclusive)
 			e.clear(false, true)
 		case 1: // Erase from beginning ot current position (inclusive)
 			e.clear(true, false)
 		case 2: // Erase entire display
 			e.clear(true, true)
+		case 3: // Erase saved lines (xterm)
+			e.display.ClearScrollback()
 		}
 
-	case 'c':
-		e.output("\x1b[?62;1;2;7;8;9;15;18;21;44;45;46c")
+	case 'S': // SU - Scroll Up
+		e.scrollUp(seq.csiParam(1))
+
+	case 'T': // SD - Scroll Down
+		_, params := seq.parseCSIParam(nil)
+		if len(params) > 1 {
+			// Initiate highlight mouse tracking (xterm)
+			e.debug("unsupported ESC[%sT", seq)
+		} else {
+			e.scrollDown(seq.csiParam(1))
+		}
+
+	case 'c': // DA - Device Attributes
+		e.deviceAttributes(seq.csiPrefixParam(0))
+
+	case 'n': // DSR - Device Status Report
+		prefix, mode := seq.csiPrefixParam(0)
+		e.deviceStatusReport(prefix == "?", mode)
 
 	case 'd': // VPA - Vertical Position Absolute (depends on PUM)
-		e.moveTo(state.csiParam(1)-1, e.Cursor.X)
+		e.moveTo(seq.csiParam(1)-1, e.Cursor.X)
 
 	case 'f': // HVP - Horizontal and Vertical Position (depends on PUM)
-		_, row, col := state.csiParams(1, 1)
-		e.moveTo(row-1, col-1)
+		_, row, col := seq.csiParams(1, 1)
+		e.cursorPosition(row, col)
 
 	case 'h':
-		prefix, mode := state.csiPrefixParam(0)
+		prefix, mode := seq.csiPrefixParam(0)
 		switch prefix {
 		case "": // Set Mode (SM)
 			switch mode {
 			case 2: // Keyboard Action Mode (AM)
 			case 4: // Insert Mode (IRM)
+				e.insertMode = true
 			case 12: // Send/receive (SRM)
 			case 20: // Automatic Newline (LNM)
+				e.newlineMode = true
 
 			default:
 				e.debug("Set Mode (SM): unknown mode %d", mode)
@@ -218,18 +640,57 @@ func actCSI(e *Emulator, state *state, ch int) {
 			case 6: // DECOM - Origin Mode, line 1 is relative to scroll region
 				e.originMode = true
 
+			case 7: // DECAWM - Autowrap Mode
+				e.autoWrap = true
+
+			case 47: // Use Alternate Screen Buffer
+				e.switchScreen(true)
+
+			case 69: // DECLRMM - Left Right Margin Mode
+				e.leftRightMode = true
+
 			case 1034: // Interpret "meta" key, sets eight bit (eightBitInput)
 
+			case 1047: // Use Alternate Screen Buffer
+				e.switchScreen(true)
+
+			case 1048: // Save cursor as in DECSC
+				e.saveCursor()
+
+			case 1049: // Save cursor and use cleared Alternate Screen Buffer
+				if !e.alternate {
+					e.saveCursor()
+					e.switchScreen(true)
+					e.clear(true, true)
+				}
+
 			default:
-				e.debug("unsupported ESC[%sh", string(state.parameters))
+				e.debug("unsupported ESC[%sh", seq)
 			}
 		}
 
 	case 'l':
-		prefix, mode := state.csiPrefixParam(0)
+		prefix, mode := seq.csiPrefixParam(0)
 		switch prefix {
+		case "": // Reset Mode (RM)
+			switch mode {
+			case 2: // Keyboard Action Mode (AM)
+			case 4: // Replace Mode (IRM)
+				e.insertMode = false
+			case 12: // Send/receive (SRM)
+			case 20: // Automatic Newline (LNM)
+				e.newlineMode = false
+
+			default:
+				e.debug("Reset Mode (RM): unknown mode %d", mode)
+			}
+
 		case "?": // DEC*
 			switch mode {
+			case 2: // DECANM - VT52 mode
+				e.parser.SetVT52(true)
+				e.charsets = charsets{}
+
 			case 3: // DECCOLM - 80 characters per line (erases screen)
 				e.clear(true, true)
 				e.Resize(80, e.Size.Y)
@@ -238,250 +699,416 @@ func actCSI(e *Emulator, state *state, ch int) {
 			case 6: // DECOM - Line numbers are independent of scrolling region
 				e.originMode = false
 
+			case 7: // DECAWM - No Autowrap Mode
+				e.autoWrap = false
+				e.overflow = false
+
+			case 47: // Use Normal Screen Buffer
+				e.switchScreen(false)
+
+			case 69: // DECLRMM - Disable Left Right Margin Mode
+				e.leftRightMode = false
+				e.resetHorizontalMargins()
+
+			case 1047: // Use Normal Screen Buffer, clearing screen first
+				if e.alternate {
+					e.clear(true, true)
+				}
+				e.switchScreen(false)
+
+			case 1048: // Restore cursor as in DECRC
+				e.restoreCursor()
+
+			case 1049: // Use Normal Screen Buffer and restore cursor
+				if e.alternate {
+					e.switchScreen(false)
+					e.restoreCursor()
+				}
+
 			default:
-				e.debug("unsupported ESC[%sl", string(state.parameters))
+				e.debug("unsupported ESC[%sl", seq)
 			}
 
 		default:
-			e.debug("unsupported ESC[%sl", string(state.parameters))
+			e.debug("unsupported ESC[%sl", seq)
 		}
 
 	case 'm':
-		_, params := state.parseCSIParam(nil)
-		for _, param := range params {
+		_, params := seq.parseCSISubParams()
+		for i := 0; i < len(params); i++ {
+			param := params[i][0]
 			switch param {
 			case 0: // Clear all special attributes
+				// The DECSCA protection is not an SGR attribute.
+				protected := e.ch.Protected
 				e.ch = e.Default
+				e.ch.Protected = protected
 
 			case 1: // Bold or increased intensity
 				e.ch.Bold = true
 
 			case 2: // Dim or secondary color on GIGI
-				e.ch.Foreground = White
+				e.ch.Dim = true
 
 			case 3: // Italic
 				e.ch.Italic = true
 
 			case 4: // Underscore
-				e.ch.Underline = true
+				style := UnderlineSingle
+				if len(params[i]) > 1 {
+					// Underline style 4:0 - 4:5
+					style = UnderlineStyle(params[i][1])
+					if style > UnderlineDashed {
+						style = UnderlineSingle
+					}
+				}
+				e.ch.SetUnderline(style)
+
+			case 5: // Blink
+				e.ch.Blink = true
+
+			case 6: // Rapid blink
+				e.ch.RapidBlink = true
 
 			case 7: // Negative image
-				old := e.ch
-				e.ch.Foreground = old.Background
-				e.ch.Background = old.Foreground
+				e.ch.Reverse = true
+
+			case 8: // Concealed characters
+				e.ch.Conceal = true
+
+			case 9: // Crossed-out characters
+				e.ch.Strikethrough = true
+
+			case 21: // Doubly underlined
+				e.ch.SetUnderline(UnderlineDouble)
 
 			case 22: // Cancel bold or dim attribute only (VT220)
 				e.ch.Bold = false
-				e.ch.Foreground = e.Default.Foreground
+				e.ch.Dim = false
+
+			case 23: // Cancel italic
+				e.ch.Italic = false
 
 			case 24: // Cancel underline attribute only (VT220)
-				e.ch.Underline = false
+				e.ch.SetUnderline(UnderlineNone)
+
+			case 25: // Cancel blink attribute only (VT220)
+				e.ch.Blink = false
+				e.ch.RapidBlink = false
 
 			case 27: // Cancel negative image attribute only (VT220)
-				old := e.ch
-				e.ch.Foreground = old.Background
-				e.ch.Background = old.Foreground
+				e.ch.Reverse = false
+
+			case 28: // Cancel concealed characters
+				e.ch.Conceal = false
+
+			case 29: // Cancel crossed-out characters
+				e.ch.Strikethrough = false
 
 			case 30: // Write with black
-				e.ch.Foreground = Black
+				e.ch.Foreground = e.palette.Colors[0]
 
 			case 31: // Write with red
-				e.ch.Foreground = Red
+				e.ch.Foreground = e.palette.Colors[1]
 
 			case 32: // Write with green
-				e.ch.Foreground = Green
+				e.ch.Foreground = e.palette.Colors[2]
 
 			case 33: // Write with yellow
-				e.ch.Foreground = Yellow
+				e.ch.Foreground = e.palette.Colors[3]
 
 			case 34: // Write with blue
-				e.ch.Foreground = Blue
+				e.ch.Foreground = e.palette.Colors[4]
 
 			case 35: // Write with magenta
-				e.ch.Foreground = Magenta
+				e.ch.Foreground = e.palette.Colors[5]
 
 			case 36: // Write with cyan
-				e.ch.Foreground = Cyan
+				e.ch.Foreground = e.palette.Colors[6]
 
 			case 37: // Write with white
-				e.ch.Foreground = White
+				e.ch.Foreground = e.palette.Colors[7]
+
+			case 38: // Set foreground color (256-color or RGB)
+				c, n, ok := e.palette.sgrColor(params[i:])
+				if ok {
+					e.ch.Foreground = c
+				} else {
+					e.debug("ESC[%sm: invalid foreground color",
+						seq)
+				}
+				i += n
+
+			case 39: // Default foreground color
+				e.ch.Foreground = e.Default.Foreground
 
 			case 40: // Set background to black
-				e.ch.Background = Black
+				e.ch.Background = e.palette.Colors[0]
 
 			case 41: // Set background to red
-				e.ch.Background = Red
+				e.ch.Background = e.palette.Colors[1]
 
 			case 42: // Set background to green
-				e.ch.Background = Green
+				e.ch.Background = e.palette.Colors[2]
 
 			case 43: // Set background to yellow
-				e.ch.Background = Yellow
+				e.ch.Background = e.palette.Colors[3]
 
 			case 44: // Set background to blue
-				e.ch.Background = Blue
+				e.ch.Background = e.palette.Colors[4]
 
 			case 45: // Set background to magenta
-				e.ch.Background = Magenta
+				e.ch.Background = e.palette.Colors[5]
 
 			case 46: // Set background to cyan
-				e.ch.Background = Cyan
+				e.ch.Background = e.palette.Colors[6]
 
 			case 47: // Set background to white
-				e.ch.Background = White
+				e.ch.Background = e.palette.Colors[7]
+
+			case 48: // Set background color (256-color or RGB)
+				c, n, ok := e.palette.sgrColor(params[i:])
+				if ok {
+					e.ch.Background = c
+				} else {
+					e.debug("ESC[%sm: invalid background color",
+						seq)
+				}
+				i += n
+
+			case 49: // Default background color
+				e.ch.Background = e.Default.Background
+
+			case 53: // Overlined
+				e.ch.Overline = true
+
+			case 55: // Cancel overlined
+				e.ch.Overline = false
+
+			case 58: // Set underline color (256-color or RGB)
+				c, n, ok := e.palette.sgrColor(params[i:])
+				if ok {
+					e.ch.UnderlineColor = c
+				} else {
+					e.debug("ESC[%sm: invalid underline color",
+						seq)
+				}
+				i += n
+
+			case 59: // Default underline color
+				e.ch.UnderlineColor = e.Default.UnderlineColor
 
 			default:
-				e.debug("ESC[%sm: unknown attribute: %d",
-					string(state.parameters), param)
+				switch {
+				case param >= 90 && param <= 97: // Bright foreground
+					e.ch.Foreground = e.palette.Colors[param-90+8]
+
+				case param >= 100 && param <= 107: // Bright background
+					e.ch.Background = e.palette.Colors[param-100+8]
+
+				default:
+					e.debug("ESC[%sm: unknown attribute: %d",
+						seq, param)
+				}
 			}
 		}
 
 	case 'r': // DECSTBM - Set top and bottom margins (scroll region on VT100)
-		_, top, bottom := state.csiParams(1, e.Size.Y)
-		e.scrollTop = top - 1
-		if e.scrollTop >= e.Size.Y {
-			e.scrollTop = e.Size.Y - 1
+		_, top, bottom := seq.csiParams(1, e.Size.Y)
+		if bottom > e.Size.Y {
+			bottom = e.Size.Y
 		}
+		if top >= bottom {
+			// The scrolling region must have at least two lines.
+			e.debug("DECSTBM: invalid region %d;%d", top, bottom)
+			break
+		}
+		e.scrollTop = top - 1
 		e.scrollBottom = bottom - 1
-		if e.scrollBottom >= e.Size.Y {
-			e.scrollBottom = e.Size.Y - 1
+
+	case 's':
+		if e.leftRightMode {
+			// DECSLRM - Set Left and Right Margins
+			_, left, right := seq.csiParams(1, e.Size.X)
+			e.setHorizontalMargins(left-1, right-1)
+			e.home()
+		} else if seq.empty() {
+			// SCOSC - Save cursor
+			e.saveCursor()
+		} else {
+			e.debug("unsupported ESC[%ss", seq)
+		}
+
+	case 'u': // SCORC - Restore cursor
+		if seq.empty() {
+			e.restoreCursor()
+		} else {
+			e.debug("unsupported ESC[%su", seq)
 		}
 
 	default:
 		e.debug("actCSI: unsupported: ESC[%s%c (0x%x)",
-			string(state.parameters), ch, ch)
+			seq, ch, ch)
 	}
 }
 
-type transition struct {
-	action action
-	next   *state
-}
+func actCSIIntermediate(e *Emulator, seq *sequence, ch int) {
+	im := seq.csiIntermediate()
+	switch im + string(rune(ch)) {
+	case "$p": // DECRQM - Request Mode
+		prefix, mode := seq.csiPrefixParam(0)
+		e.output("\x1b[%s%d;%d$y", prefix, mode,
+			e.modeStatus(prefix == "?", mode))
 
-type state struct {
-	name          string
-	defaultAction action
-	parameters    []rune
-	transitions   map[int]*transition
-}
+	case "$w": // DECRQPSR - Request Presentation State Report
+		switch seq.csiParam(0) {
+		case 2: // DECTABSR - Tab Stop Report
+			e.output("\x1bP2$u%s\x1b\\", e.tabStopReport())
 
-func (s *state) String() string {
-	return s.name
-}
+		default:
+			e.debug("unsupported ESC[%s%c", seq, ch)
+		}
 
-func (s *state) reset() {
-	s.parameters = nil
-}
+	case "$x": // DECFRA - Fill Rectangular Area
+		_, p := seq.parseCSIParam([]int{0, 1, 1, 0, 0})
+		if (p[0] < 0x20 || p[0] > 0x7e) && (p[0] < 0xa0 || p[0] > 0xff) {
+			e.debug("DECFRA: invalid fill character %d", p[0])
+			break
+		}
+		if from, to, ok := e.rectangle(p[1], p[2], p[3], p[4]); ok {
+			e.fillRect(from, to, e.ch.Clone(rune(p[0])))
+		}
 
-func (s *state) addActions(from, to int, act action, next *state) {
-	transition := &transition{
-		action: act,
-		next:   next,
-	}
+	case "$z": // DECERA - Erase Rectangular Area
+		_, p := seq.parseCSIParam([]int{1, 1, 0, 0})
+		if from, to, ok := e.rectangle(p[0], p[1], p[2], p[3]); ok {
+			e.lastValid = false
+			e.display.Clear(from, to)
+		}
+
+	case "${": // DECSERA - Selective Erase Rectangular Area
+		_, p := seq.parseCSIParam([]int{1, 1, 0, 0})
+		if from, to, ok := e.rectangle(p[0], p[1], p[2], p[3]); ok {
+			e.lastValid = false
+			e.erase(from, to, true)
+		}
+
+	case "$v": // DECCRA - Copy Rectangular Area
+		_, p := seq.parseCSIParam([]int{1, 1, 0, 0, 1, 1, 1, 1})
+		if from, to, ok := e.rectangle(p[0], p[1], p[2], p[3]); ok {
+			e.copyArea(from, to, p[5], p[6])
+		}
+
+	case "$r": // DECCARA - Change Attributes in Rectangular Area
+		_, p := seq.parseCSIParam([]int{1, 1, 0, 0})
+		from, to, ok := e.rectangle(p[0], p[1], p[2], p[3])
+		if ok || (!e.attrRectangle && from.Y < to.Y) {
+			e.changeAttributes(from, to, p[4:], false)
+		}
+
+	case "$t": // DECRARA - Reverse Attributes in Rectangular Area
+		_, p := seq.parseCSIParam([]int{1, 1, 0, 0})
+		from, to, ok := e.rectangle(p[0], p[1], p[2], p[3])
+		if ok || (!e.attrRectangle && from.Y < to.Y) {
+			e.changeAttributes(from, to, p[4:], true)
+		}
+
+	case " q": // DECSCUSR - Set Cursor Style
+		style := seq.csiParam(1)
+		if style > int(CursorSteadyBar) {
+			e.debug("DECSCUSR: invalid cursor style %d", style)
+			break
+		}
+		e.CursorStyle = CursorStyle(style)
+
+	case "!p": // DECSTR - Soft Terminal Reset
+		e.SoftReset()
 
-	for ; from <= to; from++ {
-		s.transitions[from] = transition
+	case "\"q": // DECSCA - Select Character Protection Attribute
+		switch seq.csiParam(0) {
+		case 0, 2:
+			e.ch.Protected = false
+		case 1:
+			e.ch.Protected = true
+		}
+
+	case "*x": // DECSACE - Select Attribute Change Extent
+		switch seq.csiParam(0) {
+		case 0, 1:
+			e.attrRectangle = false
+		case 2:
+			e.attrRectangle = true
+		}
+
+	case "*y": // DECRQCRA - Request Checksum of Rectangular Area
+		_, p := seq.parseCSIParam([]int{0, 1, 1, 1, 0, 0})
+		var checksum int
+		if from, to, ok := e.rectangle(p[2], p[3], p[4], p[5]); ok {
+			checksum = e.checksumRect(from, to)
+		}
+		e.output("\x1bP%d!~%04X\x1b\\", p[0], checksum)
+
+	default:
+		e.debug("actCSI: unsupported: ESC[%s%c (0x%x)",
+			seq, ch, ch)
 	}
 }
 
-func (s *state) input(e *Emulator, code int) *state {
-	var act action
-	var next *state
+func actVT52Escape(e *Emulator, seq *sequence, ch int) {
+	switch ch {
+	case 'A': // Cursor up
+		e.moveTo(e.Cursor.Y-1, e.Cursor.X)
 
-	transition, ok := s.transitions[code]
-	if ok {
-		act = transition.action
-		next = transition.next
-	} else {
-		act = s.defaultAction
-	}
+	case 'B': // Cursor down
+		e.moveTo(e.Cursor.Y+1, e.Cursor.X)
 
-	if act != nil {
-		act(e, s, code)
-	}
+	case 'C': // Cursor right
+		e.moveTo(e.Cursor.Y, e.Cursor.X+1)
 
-	return next
-}
+	case 'D': // Cursor left
+		e.moveTo(e.Cursor.Y, e.Cursor.X-1)
 
-func (s *state) params() []string {
-	return strings.Split(string(s.parameters), ";")
-}
+	case 'F': // Enter graphics mode
+		e.charsets.designate('(', CharsetDECSpecialGraphics)
 
-func (s *state) csiParam(a int) int {
-	_, values := s.parseCSIParam([]int{a})
-	return values[0]
-}
+	case 'G': // Exit graphics mode
+		e.charsets.designate('(', CharsetASCII)
 
-func (s *state) csiPrefixParam(a int) (string, int) {
-	prefix, values := s.parseCSIParam([]int{a})
-	return prefix, values[0]
-}
+	case 'H': // Cursor to home
+		e.moveTo(0, 0)
 
-func (s *state) csiParams(a, b int) (string, int, int) {
-	prefix, values := s.parseCSIParam([]int{a, b})
-	return prefix, values[0], values[1]
-}
+	case 'I': // Reverse line feed
+		e.ri()
 
-var reParam = regexp.MustCompilePOSIX("^([^0-9;:]*)([0-9;:]*)$")
+	case 'J': // Erase to end of screen
+		e.clear(false, true)
 
-func (s *state) parseCSIParam(defaults []int) (string, []int) {
-	matches := reParam.FindStringSubmatch(string(s.parameters))
-	if matches == nil {
-		return "", defaults
-	}
-	for idx, param := range strings.Split(matches[2], ";") {
-		i, err := strconv.Atoi(param)
-		if err != nil || i == 0 {
-			if idx < len(defaults) {
-				i = defaults[idx]
-			}
+	case 'K': // Erase to end of line
+		e.clearLine(e.Cursor.Y, e.Cursor.X, e.Size.X)
+
+	case 'Y': // Direct cursor address
+		// The parser passes the row and column as intermediates.
+		if len(seq.intermediates) != 2 {
+			e.debug("invalid VT52 ESC Y%s", seq.intermediates)
+			break
 		}
-		if idx < len(defaults) {
-			defaults[idx] = i
-		} else {
-			defaults = append(defaults, i)
+		row := int(seq.intermediates[0]) - 0x20
+		if row >= e.Size.Y {
+			// Out of range row keeps the current line.
+			row = e.Cursor.Y
 		}
-	}
+		e.moveTo(row, int(seq.intermediates[1])-0x20)
 
-	return matches[1], defaults
-}
+	case 'Z': // Identify
+		e.output("\x1b/Z")
 
-func newState(name string, def action) *state {
-	return &state{
-		name:          name,
-		defaultAction: def,
-		transitions:   make(map[int]*transition),
-	}
-}
+	case '=': // Enter alternate keypad mode
+	case '>': // Exit alternate keypad mode
 
-var (
-	stStart  = newState("start", actInsertChar)
-	stESC    = newState("ESC", actError)
-	stCSI    = newState("CSI", actError)
-	stESCSeq = newState("ESCSeq", actError)
-	stOSC    = newState("OSC", actError)
-)
+	case '<': // Enter ANSI mode
+		e.parser.SetVT52(false)
 
-func init() {
-	stStart.addActions(0x00, 0x1f, actC0Control, nil)
-	stStart.addActions(0x9b, 0x9b, nil, stCSI)
-	stStart.addActions(0x1b, 0x1b, nil, stESC)
-
-	stESC.addActions(0x20, 0x2f, actAppendParam, nil)
-	stESC.addActions(0x30, 0x3f, actPrivateFunction, stStart)
-	stESC.addActions(0x40, 0x5f, actC1Control, stStart)
-	stESC.addActions(0x60, 0x7e, actTwoCharEscape, stStart)
-	stESC.addActions(0x7f, 0x7f, nil, nil)            // Delete always ignored
-	stESC.addActions(0x20, 0x20, actInsertSpace, nil) // Always space
-	stESC.addActions(0xa0, 0xa0, actInsertSpace, nil) // Always space
-	stESC.addActions('[', '[', nil, stCSI)
-	stESC.addActions(']', ']', nil, stOSC)
-
-	stOSC.addActions(0x20, 0x7e, actAppendParam, nil)
-	stOSC.addActions(0x07, 0x07, actOSC, stStart)
-	stOSC.addActions(0x9c, 0x9c, actOSC, stStart)
-
-	stCSI.addActions(0x00, 0x1f, actC0Control, nil)
-	stCSI.addActions(0x30, 0x3f, actAppendParam, nil)
-	stCSI.addActions(0x40, 0x7e, actCSI, stStart)
+	default:
+		e.debug("unsupported VT52 ESC %c (0x%x)", ch, ch)
+	}
 }
@@ -0,0 +1,222 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Bright emulator color codes.
+var (
+	BrightBlack   = color.NRGBA{0x7f, 0x7f, 0x7f, 0xff}
+	BrightRed     = color.NRGBA{0xff, 0x00, 0x00, 0xff}
+	BrightGreen   = color.NRGBA{0x00, 0xff, 0x00, 0xff}
+	BrightYellow  = color.NRGBA{0xff, 0xff, 0x00, 0xff}
+	BrightBlue    = color.NRGBA{0x5c, 0x5c, 0xff, 0xff}
+	BrightMagenta = color.NRGBA{0xff, 0x00, 0xff, 0xff}
+	BrightCyan    = color.NRGBA{0x00, 0xff, 0xff, 0xff}
+)
+
+var ansiColors = []color.NRGBA{
+	Black, Red, Green, Yellow, Blue, Magenta, Cyan, White,
+	BrightBlack, BrightRed, BrightGreen, BrightYellow,
+	BrightBlue, BrightMagenta, BrightCyan, BrightWhite,
+}
+
+// Palette defines the emulator color palette. The first 16 entries
+// of Colors are the ANSI colors, used with the SGR 30-37, 40-47,
+// 90-97, and 100-107 attributes.
+type Palette struct {
+	Colors     [256]color.NRGBA
+	Foreground color.NRGBA
+	Background color.NRGBA
+	Cursor     color.NRGBA
+}
+
+// DefaultPalette returns the default xterm color palette with black
+// foreground on white background.
+func DefaultPalette() Palette {
+	p := Palette{
+		Foreground: Black,
+		Background: BrightWhite,
+		Cursor:     Black,
+	}
+	for i := range p.Colors {
+		p.Colors[i] = Color256(i)
+	}
+	return p
+}
+
+// Color256 returns the color of the xterm 256-color palette
+// index. The indices 0-15 are the ANSI colors, 16-231 are the 6x6x6
+// color cube, and 232-255 are the grayscale ramp.
+func Color256(index int) color.NRGBA {
+	switch {
+	case index < 0:
+		return ansiColors[0]
+
+	case index < 16:
+		return ansiColors[index]
+
+	case index < 232:
+		index -= 16
+		return color.NRGBA{
+			R: cubeLevel(index / 36),
+			G: cubeLevel(index / 6 % 6),
+			B: cubeLevel(index % 6),
+			A: 0xff,
+		}
+
+	case index < 256:
+		v := uint8(8 + (index-232)*10)
+		return color.NRGBA{v, v, v, 0xff}
+
+	default:
+		return ansiColors[15]
+	}
+}
+
+func cubeLevel(v int) uint8 {
+	if v == 0 {
+		return 0
+	}
+	return uint8(55 + v*40)
+}
+
+// sgrColor parses the extended color specification of the SGR 38,
+// 48, and 58 attributes. The params argument starts from the SGR
+// attribute. The function returns the color, the number of extra
+// parameters consumed, and a boolean success status.
+func (p *Palette) sgrColor(params [][]int) (color.NRGBA, int, bool) {
+	sub := params[0]
+	if len(sub) > 1 {
+		// Colon sub-parameter form: 38:5:N or 38:2:[Pi]:R:G:B.
+		switch sub[1] {
+		case 5:
+			if len(sub) < 3 {
+				return color.NRGBA{}, 0, false
+			}
+			return p.color(sub[2]), 0, true
+
+		case 2:
+			var rgb []int
+			if len(sub) >= 6 {
+				rgb = sub[3:6]
+			} else if len(sub) == 5 {
+				rgb = sub[2:5]
+			} else {
+				return color.NRGBA{}, 0, false
+			}
+			return rgbColor(rgb[0], rgb[1], rgb[2]), 0, true
+
+		default:
+			return color.NRGBA{}, 0, false
+		}
+	}
+
+	// Semicolon form: 38;5;N or 38;2;R;G;B.
+	if len(params) < 2 {
+		return color.NRGBA{}, 0, false
+	}
+	switch params[1][0] {
+	case 5:
+		if len(params) < 3 {
+			return color.NRGBA{}, len(params) - 1, false
+		}
+		return p.color(params[2][0]), 2, true
+
+	case 2:
+		if len(params) < 5 {
+			return color.NRGBA{}, len(params) - 1, false
+		}
+		return rgbColor(params[2][0], params[3][0], params[4][0]), 4, true
+
+	default:
+		return color.NRGBA{}, 1, false
+	}
+}
+
+func (p *Palette) color(index int) color.NRGBA {
+	if index < 0 || index >= len(p.Colors) {
+		return p.Foreground
+	}
+	return p.Colors[index]
+}
+
+func rgbColor(r, g, b int) color.NRGBA {
+	return color.NRGBA{
+		R: clampColor(r),
+		G: clampColor(g),
+		B: clampColor(b),
+		A: 0xff,
+	}
+}
+
+func clampColor(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
+
+// formatColor formats the color in the XParseColor rgb: format used
+// in the OSC color query replies.
+func formatColor(c color.NRGBA) string {
+	return fmt.Sprintf("rgb:%02x%02x/%02x%02x/%02x%02x",
+		c.R, c.R, c.G, c.G, c.B, c.B)
+}
+
+// parseColor parses the XParseColor color specification in the
+// rgb:r/g/b or #rgb formats. The rgb: components are scaled to 8 bits
+// where the #rgb components specify the most significant bits of the
+// color values.
+func parseColor(spec string) (color.NRGBA, error) {
+	var parts []string
+	var scale bool
+	if strings.HasPrefix(spec, "rgb:") {
+		scale = true
+		parts = strings.Split(spec[4:], "/")
+		if len(parts) != 3 {
+			return color.NRGBA{}, fmt.Errorf("invalid color: %s", spec)
+		}
+	} else if strings.HasPrefix(spec, "#") {
+		digits := spec[1:]
+		if len(digits) == 0 || len(digits)%3 != 0 || len(digits) > 12 {
+			return color.NRGBA{}, fmt.Errorf("invalid color: %s", spec)
+		}
+		n := len(digits) / 3
+		for i := 0; i < 3; i++ {
+			parts = append(parts, digits[i*n:(i+1)*n])
+		}
+	} else {
+		return color.NRGBA{}, fmt.Errorf("unsupported color: %s", spec)
+	}
+
+	var values [3]uint8
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 4 {
+			return color.NRGBA{}, fmt.Errorf("invalid color: %s", spec)
+		}
+		v, err := strconv.ParseUint(part, 16, 16)
+		if err != nil {
+			return color.NRGBA{}, fmt.Errorf("invalid color: %s", spec)
+		}
+		if scale {
+			max := uint64(1)<<(4*len(part)) - 1
+			values[i] = uint8(v * 0xff / max)
+		} else {
+			values[i] = uint8(v << (4 * (4 - len(part))) >> 8)
+		}
+	}
+	return color.NRGBA{values[0], values[1], values[2], 0xff}, nil
+}
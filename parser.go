@@ -0,0 +1,575 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// pstate defines the parser states. The states follow the DEC ANSI
+// parser by Paul Williams (https://vt100.net/emu/dec_ansi_parser),
+// extended with the VT52 escape sequence states.
+type pstate uint8
+
+const (
+	psGround pstate = iota
+	psEscape
+	psEscapeIntermediate
+	psCSIEntry
+	psCSIParam
+	psCSIIntermediate
+	psCSIIgnore
+	psDCSEntry
+	psDCSParam
+	psDCSIntermediate
+	psDCSPassthrough
+	psDCSIgnore
+	psOSCString
+	psSOSPMAPCString
+	psVT52Escape
+	psVT52Row
+	psVT52Col
+	numStates
+
+	// psNone specifies that the transition does not change the
+	// state.
+	psNone = numStates
+)
+
+var pstateNames = [numStates]string{
+	psGround:             "ground",
+	psEscape:             "escape",
+	psEscapeIntermediate: "escape-intermediate",
+	psCSIEntry:           "csi-entry",
+	psCSIParam:           "csi-param",
+	psCSIIntermediate:    "csi-intermediate",
+	psCSIIgnore:          "csi-ignore",
+	psDCSEntry:           "dcs-entry",
+	psDCSParam:           "dcs-param",
+	psDCSIntermediate:    "dcs-intermediate",
+	psDCSPassthrough:     "dcs-passthrough",
+	psDCSIgnore:          "dcs-ignore",
+	psOSCString:          "osc-string",
+	psSOSPMAPCString:     "sos-pm-apc-string",
+	psVT52Escape:         "vt52-escape",
+	psVT52Row:            "vt52-row",
+	psVT52Col:            "vt52-col",
+}
+
+func (s pstate) String() string {
+	if s < numStates {
+		return pstateNames[s]
+	}
+	return fmt.Sprintf("{pstate %d}", s)
+}
+
+// paction defines the parser actions.
+type paction uint8
+
+const (
+	paNone paction = iota
+	paPrint
+	paExecute
+	paCollect
+	paParam
+	paESCDispatch
+	paCSIDispatch
+	paPut
+	paStringPut
+	paVT52Address
+)
+
+// ptransition defines the action and the next state for an input
+// code.
+type ptransition struct {
+	action paction
+	next   pstate
+}
+
+// ptable holds the parser transitions. The codes above 0xff use the
+// transitions of 0xff.
+var ptable [numStates][256]ptransition
+
+const (
+	maxParams        = 32
+	maxParamValue    = 65535
+	maxIntermediates = 4
+	maxStringLength  = 65536
+)
+
+// StringKind defines the control string types that are delivered
+// with the Handler.StringDispatch function.
+type StringKind byte
+
+// Control string types.
+const (
+	StringSOS StringKind = 'X' // Start of String
+	StringPM  StringKind = '^' // Privacy Message
+	StringAPC StringKind = '_' // Application Program Command
+)
+
+var stringKinds = map[StringKind]string{
+	StringSOS: "SOS",
+	StringPM:  "PM",
+	StringAPC: "APC",
+}
+
+func (k StringKind) String() string {
+	name, ok := stringKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{StringKind %d}", k)
+}
+
+// Handler handles the events of the Parser.
+type Handler interface {
+	// Print prints the graphic character.
+	Print(r rune)
+	// Execute executes the C0 or C1 control function.
+	Execute(code byte)
+	// ESCDispatch dispatches the escape sequence. In the VT52 mode,
+	// the direct cursor address ESC Y is dispatched with the row and
+	// column characters as the intermediates.
+	ESCDispatch(intermediates []byte, final byte)
+	// CSIDispatch dispatches the control sequence. The private
+	// markers are passed as the leading intermediates.
+	CSIDispatch(params *Params, intermediates []byte, final byte)
+	// OSCDispatch dispatches the operating system command. The bell
+	// argument specifies if the command was terminated with BEL
+	// instead of ST. The commands that are aborted with CAN, SUB, or
+	// a C1 control, or that exceed the maximum string length, are not
+	// dispatched.
+	OSCDispatch(data []byte, bell bool)
+	// DCSHook starts the device control string. The data bytes are
+	// passed to DCSPut and the end of the string is signaled with
+	// DCSUnhook.
+	DCSHook(params *Params, intermediates []byte, final byte)
+	// DCSPut passes the device control string data character.
+	DCSPut(r rune)
+	// DCSUnhook ends the device control string. The cancel
+	// argument specifies if the string was aborted with CAN, SUB, or
+	// a C1 control instead of being terminated with ST.
+	DCSUnhook(cancel bool)
+	// StringDispatch dispatches the SOS, PM, or APC control string.
+	// Like the operating system commands, the aborted strings and
+	// the strings that exceed the maximum string length are not
+	// dispatched.
+	StringDispatch(kind StringKind, data []byte)
+}
+
+// Params holds the control sequence parameters. The parameter values
+// are limited to 65535 and the missing values are returned as 0.
+type Params struct {
+	values [maxParams]int
+	sub    [maxParams]bool
+	n      int
+}
+
+// Len returns the number of parameters, including the sub-parameters.
+func (p *Params) Len() int {
+	return p.n
+}
+
+// Value returns the parameter i. The function returns 0 if the
+// parameter is not set.
+func (p *Params) Value(i int) int {
+	if i < 0 || i >= p.n {
+		return 0
+	}
+	return p.values[i]
+}
+
+// Sub tests if the parameter i is a colon separated sub-parameter of
+// its preceding parameter.
+func (p *Params) Sub(i int) bool {
+	if i < 0 || i >= p.n {
+		return false
+	}
+	return p.sub[i]
+}
+
+func (p *Params) String() string {
+	var sb strings.Builder
+	for i := 0; i < p.n; i++ {
+		if i > 0 {
+			if p.sub[i] {
+				sb.WriteByte(':')
+			} else {
+				sb.WriteByte(';')
+			}
+		}
+		fmt.Fprintf(&sb, "%d", p.values[i])
+	}
+	return sb.String()
+}
+
+// Parser implements the escape sequence parser. The parser tokenizes
+// the input and passes the printable characters, control functions,
+// and the parsed control sequences to its handler.
+type Parser struct {
+	handler          Handler
+	state            pstate
+	vt52             bool
+	params           Params
+	paramsFull       bool
+	intermediates    [maxIntermediates]byte
+	numIntermediates int
+	ignore           bool
+	str              []byte
+	strFull          bool
+	strKind          StringKind
+	utf8Buf          [utf8.UTFMax]byte
+	utf8Len          int
+	c1               C1Acceptor
+}
+
+// C1Acceptor is an optional interface for handlers that accept the
+// 8-bit C1 controls as raw bytes.
+type C1Acceptor interface {
+	// AcceptC1 tests if the parser's UTF-8 decoder passes the raw C1
+	// bytes (0x80-0x9f) to the state machine as control codes. The
+	// parser queries the setting at each Write call.
+	AcceptC1() bool
+}
+
+// NewParser creates a new parser for the handler.
+func NewParser(handler Handler) *Parser {
+	p := &Parser{
+		handler: handler,
+	}
+	p.c1, _ = handler.(C1Acceptor)
+	return p
+}
+
+// Reset resets the parser to the ground state. The VT52 mode is
+// reset to the ANSI mode.
+func (p *Parser) Reset() {
+	p.state = psGround
+	p.vt52 = false
+	p.clear()
+}
+
+// VT52 tests if the parser is in the VT52 mode.
+func (p *Parser) VT52() bool {
+	return p.vt52
+}
+
+// SetVT52 sets the VT52 mode. In the VT52 mode, the parser
+// recognizes the VT52 escape sequences instead of the ANSI escape
+// and control sequences.
+func (p *Parser) SetVT52(vt52 bool) {
+	p.vt52 = vt52
+}
+
+func (p *Parser) clear() {
+	p.params.n = 0
+	p.paramsFull = false
+	p.numIntermediates = 0
+	p.ignore = false
+}
+
+// Write implements the io.Writer interface. The input data is decoded
+// as UTF-8. Partial UTF-8 sequences are buffered between calls and
+// malformed input bytes are replaced with U+FFFD. The raw C1 bytes
+// are decoded as control codes if the handler implements C1Acceptor
+// and accepts them.
+func (p *Parser) Write(data []byte) (int, error) {
+	c1 := p.c1 != nil && p.c1.AcceptC1()
+	for _, b := range data {
+		if p.utf8Len == 0 {
+			if b < utf8.RuneSelf {
+				p.Input(int(b))
+				continue
+			}
+			if b < 0xa0 && c1 {
+				p.Input(int(b))
+				continue
+			}
+		}
+		p.utf8Buf[p.utf8Len] = b
+		p.utf8Len++
+		p.decodeUTF8(c1)
+	}
+	return len(data), nil
+}
+
+func (p *Parser) decodeUTF8(c1 bool) {
+	for p.utf8Len > 0 {
+		buf := p.utf8Buf[:p.utf8Len]
+		if buf[0] >= 0x80 && buf[0] < 0xa0 && c1 {
+			// Raw C1 control following a malformed sequence.
+			p.Input(int(buf[0]))
+			copy(p.utf8Buf[:], buf[1:])
+			p.utf8Len--
+			continue
+		}
+		if !utf8.FullRune(buf) {
+			return
+		}
+		r, size := utf8.DecodeRune(buf)
+		p.Input(int(r))
+		copy(p.utf8Buf[:], buf[size:])
+		p.utf8Len -= size
+	}
+}
+
+// Input runs the parser with the next input code.
+func (p *Parser) Input(code int) {
+	idx := code
+	if idx > 0xff {
+		idx = 0xff
+	} else if idx < 0 {
+		return
+	}
+	t := ptable[p.state][idx]
+	if t.next != psNone {
+		p.exit(code)
+	}
+	switch t.action {
+	case paPrint:
+		p.handler.Print(rune(code))
+	case paExecute:
+		p.handler.Execute(byte(code))
+	case paCollect:
+		p.collect(code)
+	case paParam:
+		p.param(code)
+	case paESCDispatch:
+		if !p.ignore {
+			p.handler.ESCDispatch(p.intermediates[:p.numIntermediates],
+				byte(code))
+		}
+	case paCSIDispatch:
+		if !p.ignore {
+			p.handler.CSIDispatch(&p.params,
+				p.intermediates[:p.numIntermediates], byte(code))
+		}
+	case paPut:
+		p.handler.DCSPut(rune(code))
+	case paStringPut:
+		var buf [utf8.UTFMax]byte
+		n := utf8.EncodeRune(buf[:], rune(code))
+		if len(p.str)+n > maxStringLength {
+			p.strFull = true
+		} else {
+			p.str = append(p.str, buf[:n]...)
+		}
+	case paVT52Address:
+		p.collect(code)
+		p.handler.ESCDispatch(p.intermediates[:p.numIntermediates], 'Y')
+	}
+	if t.next != psNone {
+		p.enter(t.next, code)
+	}
+}
+
+// exit runs the exit action of the current state. The exit action
+// runs before the action of the transition.
+func (p *Parser) exit(code int) {
+	switch p.state {
+	case psOSCString:
+		if stringTerminator(code) && !p.strFull {
+			p.handler.OSCDispatch(p.str, code == 0x07)
+		}
+	case psSOSPMAPCString:
+		if stringTerminator(code) && !p.strFull {
+			p.handler.StringDispatch(p.strKind, p.str)
+		}
+	case psDCSPassthrough:
+		p.handler.DCSUnhook(!stringTerminator(code))
+	}
+}
+
+// enter moves the parser to the next state and runs the entry action
+// of the state.
+func (p *Parser) enter(next pstate, code int) {
+	if next == psEscape && p.vt52 {
+		next = psVT52Escape
+	}
+	p.state = next
+	switch next {
+	case psEscape, psCSIEntry, psDCSEntry, psVT52Escape:
+		p.clear()
+	case psOSCString:
+		p.str = p.str[:0]
+		p.strFull = false
+	case psSOSPMAPCString:
+		p.str = p.str[:0]
+		p.strFull = false
+		if code >= 0x80 {
+			// 8-bit C1 control to its 7-bit ESC Fe final byte.
+			code -= 0x40
+		}
+		p.strKind = StringKind(code)
+	case psDCSPassthrough:
+		if p.ignore {
+			p.state = psDCSIgnore
+		} else {
+			p.handler.DCSHook(&p.params,
+				p.intermediates[:p.numIntermediates], byte(code))
+		}
+	}
+}
+
+// stringTerminator tests if the code terminates a control string.
+// The ESC starts the 7-bit ST (ESC \) and it terminates the string
+// even if it is not followed by the backslash. The BEL terminates the
+// OSC strings.
+func stringTerminator(code int) bool {
+	return code == 0x07 || code == 0x1b || code == 0x9c
+}
+
+func (p *Parser) collect(code int) {
+	if p.numIntermediates >= maxIntermediates {
+		p.ignore = true
+		return
+	}
+	p.intermediates[p.numIntermediates] = byte(code)
+	p.numIntermediates++
+}
+
+func (p *Parser) param(code int) {
+	params := &p.params
+	if params.n == 0 {
+		params.values[0] = 0
+		params.sub[0] = false
+		params.n = 1
+	}
+	if code == ';' || code == ':' {
+		if params.n >= maxParams {
+			p.paramsFull = true
+			return
+		}
+		params.values[params.n] = 0
+		params.sub[params.n] = code == ':'
+		params.n++
+		return
+	}
+	if p.paramsFull {
+		return
+	}
+	v := params.values[params.n-1]*10 + code - '0'
+	if v > maxParamValue {
+		v = maxParamValue
+	}
+	params.values[params.n-1] = v
+}
+
+func init() {
+	for s := range ptable {
+		for c := range ptable[s] {
+			ptable[s][c] = ptransition{
+				action: paNone,
+				next:   psNone,
+			}
+		}
+	}
+	set := func(s pstate, from, to int, action paction, next pstate) {
+		for c := from; c <= to; c++ {
+			ptable[s][c] = ptransition{
+				action: action,
+				next:   next,
+			}
+		}
+	}
+	c0 := func(s pstate, action paction) {
+		set(s, 0x00, 0x17, action, psNone)
+		set(s, 0x19, 0x19, action, psNone)
+		set(s, 0x1c, 0x1f, action, psNone)
+	}
+
+	c0(psGround, paExecute)
+	set(psGround, 0x20, 0x7e, paPrint, psNone)
+	set(psGround, 0xa0, 0xff, paPrint, psNone)
+
+	c0(psEscape, paExecute)
+	set(psEscape, 0x20, 0x2f, paCollect, psEscapeIntermediate)
+	set(psEscape, 0x30, 0x7e, paESCDispatch, psGround)
+	set(psEscape, 'P', 'P', paNone, psDCSEntry)
+	set(psEscape, 'X', 'X', paNone, psSOSPMAPCString)
+	set(psEscape, '[', '[', paNone, psCSIEntry)
+	set(psEscape, ']', ']', paNone, psOSCString)
+	set(psEscape, '^', '_', paNone, psSOSPMAPCString)
+
+	c0(psEscapeIntermediate, paExecute)
+	set(psEscapeIntermediate, 0x20, 0x2f, paCollect, psNone)
+	set(psEscapeIntermediate, 0x30, 0x7e, paESCDispatch, psGround)
+
+	c0(psCSIEntry, paExecute)
+	set(psCSIEntry, 0x20, 0x2f, paCollect, psCSIIntermediate)
+	set(psCSIEntry, 0x30, 0x3b, paParam, psCSIParam)
+	set(psCSIEntry, 0x3c, 0x3f, paCollect, psCSIParam)
+	set(psCSIEntry, 0x40, 0x7e, paCSIDispatch, psGround)
+
+	c0(psCSIParam, paExecute)
+	set(psCSIParam, 0x20, 0x2f, paCollect, psCSIIntermediate)
+	set(psCSIParam, 0x30, 0x3b, paParam, psNone)
+	set(psCSIParam, 0x3c, 0x3f, paNone, psCSIIgnore)
+	set(psCSIParam, 0x40, 0x7e, paCSIDispatch, psGround)
+
+	c0(psCSIIntermediate, paExecute)
+	set(psCSIIntermediate, 0x20, 0x2f, paCollect, psNone)
+	set(psCSIIntermediate, 0x30, 0x3f, paNone, psCSIIgnore)
+	set(psCSIIntermediate, 0x40, 0x7e, paCSIDispatch, psGround)
+
+	c0(psCSIIgnore, paExecute)
+	set(psCSIIgnore, 0x40, 0x7e, paNone, psGround)
+
+	set(psDCSEntry, 0x20, 0x2f, paCollect, psDCSIntermediate)
+	set(psDCSEntry, 0x30, 0x3b, paParam, psDCSParam)
+	set(psDCSEntry, 0x3c, 0x3f, paCollect, psDCSParam)
+	set(psDCSEntry, 0x40, 0x7e, paNone, psDCSPassthrough)
+
+	set(psDCSParam, 0x20, 0x2f, paCollect, psDCSIntermediate)
+	set(psDCSParam, 0x30, 0x3b, paParam, psNone)
+	set(psDCSParam, 0x3c, 0x3f, paNone, psDCSIgnore)
+	set(psDCSParam, 0x40, 0x7e, paNone, psDCSPassthrough)
+
+	set(psDCSIntermediate, 0x20, 0x2f, paCollect, psNone)
+	set(psDCSIntermediate, 0x30, 0x3f, paNone, psDCSIgnore)
+	set(psDCSIntermediate, 0x40, 0x7e, paNone, psDCSPassthrough)
+
+	c0(psDCSPassthrough, paPut)
+	set(psDCSPassthrough, 0x20, 0x7e, paPut, psNone)
+	set(psDCSPassthrough, 0xa0, 0xff, paPut, psNone)
+
+	set(psOSCString, 0x07, 0x07, paNone, psGround)
+	set(psOSCString, 0x20, 0x7e, paStringPut, psNone)
+	set(psOSCString, 0xa0, 0xff, paStringPut, psNone)
+
+	set(psSOSPMAPCString, 0x20, 0x7e, paStringPut, psNone)
+	set(psSOSPMAPCString, 0xa0, 0xff, paStringPut, psNone)
+
+	c0(psVT52Escape, paExecute)
+	set(psVT52Escape, 0x20, 0x7e, paESCDispatch, psGround)
+	set(psVT52Escape, 'Y', 'Y', paNone, psVT52Row)
+
+	c0(psVT52Row, paExecute)
+	set(psVT52Row, 0x20, 0x7e, paCollect, psVT52Col)
+
+	c0(psVT52Col, paExecute)
+	set(psVT52Col, 0x20, 0x7e, paVT52Address, psGround)
+
+	// Transitions from anywhere.
+	for s := pstate(0); s < numStates; s++ {
+		set(s, 0x18, 0x18, paExecute, psGround)
+		set(s, 0x1a, 0x1a, paExecute, psGround)
+		set(s, 0x1b, 0x1b, paNone, psEscape)
+		set(s, 0x80, 0x8f, paExecute, psGround)
+		set(s, 0x90, 0x90, paNone, psDCSEntry)
+		set(s, 0x91, 0x97, paExecute, psGround)
+		set(s, 0x98, 0x98, paNone, psSOSPMAPCString)
+		set(s, 0x99, 0x9a, paExecute, psGround)
+		set(s, 0x9b, 0x9b, paNone, psCSIEntry)
+		set(s, 0x9c, 0x9c, paNone, psGround)
+		set(s, 0x9d, 0x9d, paNone, psOSCString)
+		set(s, 0x9e, 0x9f, paNone, psSOSPMAPCString)
+	}
+}
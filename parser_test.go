@@ -0,0 +1,328 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recorder implements the Handler interface and records the parser
+// events.
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Print(ch rune) {
+	r.events = append(r.events, fmt.Sprintf("print %c", ch))
+}
+
+func (r *recorder) Execute(code byte) {
+	r.events = append(r.events, fmt.Sprintf("execute 0x%02x", code))
+}
+
+func (r *recorder) ESCDispatch(intermediates []byte, final byte) {
+	r.events = append(r.events, fmt.Sprintf("esc %q %c", intermediates, final))
+}
+
+func (r *recorder) CSIDispatch(params *Params, intermediates []byte,
+	final byte) {
+	r.events = append(r.events,
+		fmt.Sprintf("csi %s %q %c", params, intermediates, final))
+}
+
+func (r *recorder) OSCDispatch(data []byte, bell bool) {
+	r.events = append(r.events, fmt.Sprintf("osc %q %v", data, bell))
+}
+
+func (r *recorder) DCSHook(params *Params, intermediates []byte,
+	final byte) {
+	r.events = append(r.events,
+		fmt.Sprintf("hook %s %q %c", params, intermediates, final))
+}
+
+func (r *recorder) DCSPut(ch rune) {
+	r.events = append(r.events, fmt.Sprintf("put %c", ch))
+}
+
+func (r *recorder) DCSUnhook(cancel bool) {
+	r.events = append(r.events, fmt.Sprintf("unhook %v", cancel))
+}
+
+func (r *recorder) StringDispatch(kind StringKind, data []byte) {
+	r.events = append(r.events, fmt.Sprintf("%s %q", kind, data))
+}
+
+var parserEventTests = []struct {
+	i  string
+	vt bool
+	o  []string
+}{
+	{
+		i: "a\r",
+		o: []string{"print a", "execute 0x0d"},
+	},
+	{
+		i: "\x1b[m",
+		o: []string{`csi  "" m`},
+	},
+	{
+		i: "\x1b[?12;3:4:5;;99999h",
+		o: []string{`csi 12;3:4:5;0;65535 "?" h`},
+	},
+	{
+		i: "\x1b[;H",
+		o: []string{`csi 0;0 "" H`},
+	},
+	{
+		i: "\x1b[>1 !q",
+		o: []string{`csi 1 "> !" q`},
+	},
+	{
+		i: "\x1b(0\x1b7",
+		o: []string{`esc "(" 0`, `esc "" 7`},
+	},
+	{
+		i: "\x1b]0;title\x07\x1b]2;\u00e4\x1b\\",
+		o: []string{`osc "0;title" true`, `osc "2;ä" false`,
+			`esc "" \`},
+	},
+	{
+		i: "\x1bP1;2$qm\x1b\\",
+		o: []string{`hook 1;2 "$" q`, "put m", "unhook false", `esc "" \`},
+	},
+	{ // CAN and SUB abort the sequence
+		i: "\x1b[1\x18m\x1b(\x1a0",
+		o: []string{"execute 0x18", "print m", "execute 0x1a", "print 0"},
+	},
+	{ // C0 controls execute inside the sequence
+		i: "\x1b[1\r;2\nH",
+		o: []string{"execute 0x0d", "execute 0x0a", `csi 1;2 "" H`},
+	},
+	{ // ESC restarts the sequence
+		i: "\x1b[12\x1b[3m",
+		o: []string{`csi 3 "" m`},
+	},
+	{ // Aborted OSC is not dispatched
+		i: "\x1b]0;abc\x18\x1b]0;def\x1a\x1b]0;ghi\u0085",
+		o: []string{"execute 0x18", "execute 0x1a", "execute 0x85"},
+	},
+	{ // 8-bit ST terminates OSC
+		i: "\u009d0;abc\u009c",
+		o: []string{`osc "0;abc" false`},
+	},
+	{ // ESC terminates OSC
+		i: "\x1b]0;abc\x1b[m",
+		o: []string{`osc "0;abc" false`, `csi  "" m`},
+	},
+	{ // Aborted DCS is canceled
+		i: "\x1bPqa\x18\u0090qb\u009c",
+		o: []string{`hook  "" q`, "put a", "unhook true", "execute 0x18",
+			`hook  "" q`, "put b", "unhook false"},
+	},
+	{ // SOS, PM, and APC strings
+		i: "\x1bXsos\x1b\\\x1b^pm\u009c\u009f\x07a\u00e4\u009c",
+		o: []string{`SOS "sos"`, `esc "" \`, `PM "pm"`, `APC "aä"`},
+	},
+	{ // Aborted APC is not dispatched
+		i: "\x1b_Gabc\x18\x1b_Gdef\u0085",
+		o: []string{"execute 0x18", "execute 0x85"},
+	},
+	{
+		i:  "\x1bA\x1bY#$",
+		vt: true,
+		o:  []string{`esc "" A`, `esc "#$" Y`},
+	},
+}
+
+func TestParserEvents(t *testing.T) {
+	for idx, test := range parserEventTests {
+		r := new(recorder)
+		p := NewParser(r)
+		p.SetVT52(test.vt)
+		p.Write([]byte(test.i))
+		if strings.Join(r.events, "\n") != strings.Join(test.o, "\n") {
+			t.Errorf("test %d: got %q, expected %q", idx, r.events, test.o)
+		}
+	}
+}
+
+// c1Recorder records the parser events and accepts the raw C1
+// controls when accept is set.
+type c1Recorder struct {
+	recorder
+	accept bool
+}
+
+func (r *c1Recorder) AcceptC1() bool {
+	return r.accept
+}
+
+func TestParserC1Acceptor(t *testing.T) {
+	r := new(c1Recorder)
+	p := NewParser(r)
+	p.Write([]byte("\x9b1m"))
+	r.accept = true
+	p.Write([]byte("\x9b2m"))
+
+	expected := []string{"print \ufffd", "print 1", "print m", `csi 2 "" m`}
+	if fmt.Sprint(r.events) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", r.events, expected)
+	}
+}
+
+func TestParserParamLimit(t *testing.T) {
+	r := new(recorder)
+	p := NewParser(r)
+	p.Input(0x9b)
+	for i := 0; i < 2*maxParams; i++ {
+		p.Input('1')
+		p.Input(';')
+	}
+	if p.params.Len() != maxParams {
+		t.Errorf("got %d parameters, expected %d", p.params.Len(), maxParams)
+	}
+	for i := 0; i < maxParams-1; i++ {
+		if v := p.params.Value(i); v != 1 {
+			t.Errorf("param %d: got %d, expected 1", i, v)
+		}
+	}
+}
+
+func TestParserStringLimit(t *testing.T) {
+	r := new(recorder)
+	p := NewParser(r)
+	p.Write([]byte("\x1b]0;"))
+	p.Write([]byte(strings.Repeat("x", 2*maxStringLength)))
+	p.Write([]byte("\x07\x1b]0;abc\x07"))
+	if len(p.str) > maxStringLength {
+		t.Errorf("OSC buffer %d bytes, expected at most %d",
+			len(p.str), maxStringLength)
+	}
+	expected := []string{`osc "0;abc" true`}
+	if fmt.Sprint(r.events) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", r.events, expected)
+	}
+}
+
+func TestParserAPCLimit(t *testing.T) {
+	r := new(recorder)
+	p := NewParser(r)
+	p.Write([]byte("\x1b_"))
+	p.Write([]byte(strings.Repeat("x", 2*maxStringLength)))
+	p.Write([]byte("\x1b\\\x1b_abc\x1b\\"))
+	if len(p.str) > maxStringLength {
+		t.Errorf("APC buffer %d bytes, expected at most %d",
+			len(p.str), maxStringLength)
+	}
+	expected := []string{`esc "" \`, `APC "abc"`, `esc "" \`}
+	if fmt.Sprint(r.events) != fmt.Sprint(expected) {
+		t.Errorf("got %q, expected %q", r.events, expected)
+	}
+}
+
+var parserTests = []struct {
+	i string
+	o string
+}{
+	{ // C0 controls execute inside control sequences
+		i: "abc\x1b[\r2C!",
+		o: "ab!",
+	},
+	{ // DEL is ignored
+		i: "a\x7fb\x1b[\x7f3G!",
+		o: "ab!",
+	},
+	{ // Private marker inside parameters ignores the sequence
+		i: "abc\x1b[1?2D!",
+		o: "abc!",
+	},
+	{ // Too many intermediates ignores the sequence
+		i: "abc\x1b[1 !\"#$D!",
+		o: "abc!",
+	},
+	{ // ESC restarts the sequence
+		i: "abc\x1b[1\x1b[2D!",
+		o: "a!c",
+	},
+	{ // CAN aborts the sequence
+		i: "abc\x1b[2\x18D!",
+		o: "abcD!",
+	},
+	{ // SUB aborts the OSC
+		i: "a\x1b]0;title\x1ab",
+		o: "ab",
+	},
+	{ // 7-bit ST terminates the OSC
+		i: "a\x1b]0;title\x1b\\b",
+		o: "ab",
+	},
+	{ // Sub-parameters are skipped in the parameter values
+		i: "abc\x1b[2:5D!",
+		o: "a!c",
+	},
+	{ // Unknown sequences are ignored
+		i: "a\x1bPqdata\x1b\\\x1b_apc\x1b\\b",
+		o: "ab",
+	},
+}
+
+func TestParser(t *testing.T) {
+	for idx, test := range parserTests {
+		emul, display := newTestEmulator(10, 1)
+		emul.Write([]byte(test.i))
+		line := strings.TrimRight(lineString(display, 0), " ")
+		if line != test.o {
+			t.Errorf("test %d: got %q, expected %q", idx, line, test.o)
+		}
+	}
+}
+
+// benchmarkLog returns build log-like input with plain text lines,
+// SGR colored lines, and cursor movement sequences.
+func benchmarkLog() []byte {
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&sb, "compiling module %d: src/pkg/file%d.go\r\n", i, i)
+		case 1:
+			fmt.Fprintf(&sb,
+				"\x1b[1;32mok\x1b[0m   \x1b[38;5;244mpkg/%d\x1b[0m\t0.%03ds\r\n",
+				i, i)
+		case 2:
+			fmt.Fprintf(&sb, "\x1b[2K\x1b[1G[%4d/1000] \x1b[38;2;10;20;30mlinking"+
+				"\x1b[39m\r\n", i)
+		case 3:
+			fmt.Fprintf(&sb, "\x1b]0;build %d\x07warning: unused variable "+
+				"\x1b[4m'x'\x1b[24m\r\n", i)
+		}
+	}
+	return []byte(sb.String())
+}
+
+func BenchmarkWrite(b *testing.B) {
+	data := benchmarkLog()
+	emul, _ := newTestEmulator(80, 24)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		emul.Write(data)
+	}
+}
+
+func BenchmarkWritePlain(b *testing.B) {
+	data := []byte(strings.Repeat(
+		"The quick brown fox jumps over the lazy dog.\r\n", 1000))
+	emul, _ := newTestEmulator(80, 24)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		emul.Write(data)
+	}
+}
@@ -0,0 +1,269 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+// RectDisplay is an optional interface for displays that implement
+// the rectangular area operations natively. The emulator implements
+// the operations with the CharDisplay Get and Set functions for
+// displays that do not implement this interface. All areas are
+// inclusive and within the display bounds.
+type RectDisplay interface {
+	// FillRect fills the area with the character.
+	FillRect(from, to Point, char Char)
+	// CopyRect copies the area to the destination point. The source
+	// and destination areas can overlap.
+	CopyRect(from, to, dst Point)
+	// ModifyRect replaces each character of the area with the
+	// result of the modify function.
+	ModifyRect(from, to Point, modify func(ch Char) Char)
+	// SelectiveErase clears the characters of the area that are not
+	// protected.
+	SelectiveErase(from, to Point)
+}
+
+// rectBounds returns the bounds for the rectangular area
+// operations. In origin mode, the areas are relative to and clipped
+// to the margins.
+func (e *Emulator) rectBounds() (min, max Point) {
+	if e.originMode {
+		return Point{X: e.scrollLeft, Y: e.scrollTop},
+			Point{X: e.scrollRight, Y: e.scrollBottom}
+	}
+	return zeroPoint, Point{X: e.Size.X - 1, Y: e.Size.Y - 1}
+}
+
+// rectangle returns the area for the rectangular area operation
+// parameters top, left, bottom, and right. The zero bottom and right
+// select the last line and column. The ok result is false if the
+// area is empty.
+func (e *Emulator) rectangle(top, left, bottom, right int) (
+	from, to Point, ok bool) {
+
+	min, max := e.rectBounds()
+	if bottom == 0 {
+		bottom = max.Y - min.Y + 1
+	}
+	if right == 0 {
+		right = max.X - min.X + 1
+	}
+	from = Point{X: min.X + left - 1, Y: min.Y + top - 1}
+	to = Point{X: min.X + right - 1, Y: min.Y + bottom - 1}
+	if to.X > max.X {
+		to.X = max.X
+	}
+	if to.Y > max.Y {
+		to.Y = max.Y
+	}
+	return from, to, from.X <= to.X && from.Y <= to.Y
+}
+
+func (e *Emulator) fillRect(from, to Point, ch Char) {
+	e.lastValid = false
+	if rd, ok := e.display.(RectDisplay); ok {
+		rd.FillRect(from, to, ch)
+		return
+	}
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y; p.Y++ {
+		for p.X = from.X; p.X <= to.X; p.X++ {
+			e.display.Set(p, ch)
+		}
+	}
+}
+
+func (e *Emulator) copyRect(from, to, dst Point) {
+	e.lastValid = false
+	if rd, ok := e.display.(RectDisplay); ok {
+		rd.CopyRect(from, to, dst)
+		return
+	}
+	var rows [][]Char
+	for y := from.Y; y <= to.Y; y++ {
+		var row []Char
+		for x := from.X; x <= to.X; x++ {
+			row = append(row, e.display.Get(Point{X: x, Y: y}))
+		}
+		rows = append(rows, row)
+	}
+	for i, row := range rows {
+		for j, ch := range row {
+			e.display.Set(Point{X: dst.X + j, Y: dst.Y + i}, ch)
+		}
+	}
+}
+
+func (e *Emulator) modifyRect(from, to Point, modify func(ch Char) Char) {
+	if rd, ok := e.display.(RectDisplay); ok {
+		rd.ModifyRect(from, to, modify)
+		return
+	}
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y; p.Y++ {
+		for p.X = from.X; p.X <= to.X; p.X++ {
+			e.display.Set(p, modify(e.display.Get(p)))
+		}
+	}
+}
+
+// copyArea implements DECCRA. The destination is relative to the
+// margins in origin mode and the copied area is clipped to the
+// bounds.
+func (e *Emulator) copyArea(from, to Point, top, left int) {
+	min, max := e.rectBounds()
+	dst := Point{X: min.X + left - 1, Y: min.Y + top - 1}
+	if dst.X > max.X || dst.Y > max.Y {
+		return
+	}
+	if dst.X+to.X-from.X > max.X {
+		to.X = from.X + max.X - dst.X
+	}
+	if dst.Y+to.Y-from.Y > max.Y {
+		to.Y = from.Y + max.Y - dst.Y
+	}
+	e.copyRect(from, to, dst)
+}
+
+// changeAttributes implements DECCARA and DECRARA. The attributes
+// are changed for the rectangular area or for the character stream
+// from the first to the last position, as selected by DECSACE.
+func (e *Emulator) changeAttributes(from, to Point, attrs []int,
+	reverse bool) {
+
+	if len(attrs) == 0 {
+		attrs = []int{0}
+	}
+	modify := func(ch Char) Char {
+		for _, attr := range attrs {
+			if !changeAttribute(&ch, attr, reverse) {
+				e.debug("unsupported rectangle attribute %d", attr)
+			}
+		}
+		return ch
+	}
+	if e.attrRectangle || from.Y == to.Y {
+		e.modifyRect(from, to, modify)
+		return
+	}
+	min, max := e.rectBounds()
+	e.modifyRect(from, Point{X: max.X, Y: from.Y}, modify)
+	if to.Y-from.Y > 1 {
+		e.modifyRect(Point{X: min.X, Y: from.Y + 1},
+			Point{X: max.X, Y: to.Y - 1}, modify)
+	}
+	e.modifyRect(Point{X: min.X, Y: to.Y}, to, modify)
+}
+
+// changeAttribute sets (DECCARA) or reverses (DECRARA) the character
+// attribute. The function returns false if the attribute is not
+// supported.
+func changeAttribute(ch *Char, attr int, reverse bool) bool {
+	underline := ch.Underline
+	switch attr {
+	case 0:
+		if reverse {
+			ch.Bold = !ch.Bold
+			underline = !underline
+			ch.Blink = !ch.Blink
+			ch.Reverse = !ch.Reverse
+		} else {
+			ch.Bold = false
+			underline = false
+			ch.Blink = false
+			ch.Reverse = false
+		}
+	case 1:
+		ch.Bold = !reverse || !ch.Bold
+	case 4:
+		underline = !reverse || !underline
+	case 5:
+		ch.Blink = !reverse || !ch.Blink
+	case 7:
+		ch.Reverse = !reverse || !ch.Reverse
+	case 8:
+		ch.Conceal = !reverse || !ch.Conceal
+	case 22, 24, 25, 27, 28:
+		if reverse {
+			return false
+		}
+		switch attr {
+		case 22:
+			ch.Bold = false
+		case 24:
+			underline = false
+		case 25:
+			ch.Blink = false
+		case 27:
+			ch.Reverse = false
+		case 28:
+			ch.Conceal = false
+		}
+	default:
+		return false
+	}
+	if underline != ch.Underline {
+		if underline {
+			ch.SetUnderline(UnderlineSingle)
+		} else {
+			ch.SetUnderline(UnderlineNone)
+		}
+	}
+	return true
+}
+
+// checksumRect computes the DECRQCRA checksum of the area. The
+// checksum is the negated 16-bit sum of the character codes and
+// attribute bits, as in xterm. Blank cells count as spaces.
+func (e *Emulator) checksumRect(from, to Point) int {
+	// Count all characters as blanks and read only the characters
+	// of the display content; the characters outside it are blank.
+	// Only the low 16 bits of the sum are significant.
+	blank := checksumChar(Char{})
+	width := (to.X - from.X + 1) & 0xffff
+	height := (to.Y - from.Y + 1) & 0xffff
+	sum := width * height * blank
+
+	content := e.contentSize()
+	if to.X >= content.X {
+		to.X = content.X - 1
+	}
+	if to.Y >= content.Y {
+		to.Y = content.Y - 1
+	}
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y; p.Y++ {
+		for p.X = from.X; p.X <= to.X; p.X++ {
+			sum += checksumChar(e.display.Get(p)) - blank
+		}
+	}
+	return -sum & 0xffff
+}
+
+func checksumChar(ch Char) int {
+	if ch.Continuation {
+		return 0
+	}
+	sum := int(ch.Code)
+	if ch.Code == 0 || ch.Code == 0xa0 {
+		sum = ' '
+	}
+	if ch.Protected {
+		sum += 0x04
+	}
+	if ch.Underline {
+		sum += 0x10
+	}
+	if ch.Reverse {
+		sum += 0x20
+	}
+	if ch.Blink {
+		sum += 0x40
+	}
+	if ch.Bold {
+		sum += 0x80
+	}
+	return sum
+}
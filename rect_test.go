@@ -0,0 +1,219 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// plainDisplay hides the RectDisplay functions of the display so that
+// the emulator uses its fallback implementations.
+type plainDisplay struct {
+	CharDisplay
+}
+
+var rectTests = []struct {
+	i string
+	o []string
+}{
+	{ // DECFRA
+		i: "\x1b[42;2;2;3;4$x",
+		o: []string{"abcde", "f***j", "k***o", "pqrst"},
+	},
+	{ // DECFRA with invalid character
+		i: "\x1b[10;2;2;3;4$x",
+		o: []string{"abcde", "fghij", "klmno", "pqrst"},
+	},
+	{ // DECERA
+		i: "\x1b[2;2;3;4$z",
+		o: []string{"abcde", "f   j", "k   o", "pqrst"},
+	},
+	{ // DECERA defaults
+		i: "\x1b[3;4$z",
+		o: []string{"abcde", "fghij", "klm  ", "pqr  "},
+	},
+	{ // DECSERA
+		i: "\x1b[1;1;1;2${",
+		o: []string{"  cde", "fghij", "klmno", "pqrst"},
+	},
+	{ // DECCRA
+		i: "\x1b[1;1;2;2;1;3;4;1$v",
+		o: []string{"abcde", "fghij", "klmab", "pqrfg"},
+	},
+	{ // DECCRA overlapping
+		i: "\x1b[1;1;2;5;1;2;2;1$v",
+		o: []string{"abcde", "fabcd", "kfghi", "pqrst"},
+	},
+	{ // DECCRA clipped to the screen
+		i: "\x1b[1;1;4;5;1;4;4;1$v",
+		o: []string{"abcde", "fghij", "klmno", "pqrab"},
+	},
+	{ // Origin mode and margins
+		i: "\x1b[2;3r\x1b[?69h\x1b[2;4s\x1b[?6h\x1b[42$x",
+		o: []string{"abcde", "f***j", "k***o", "pqrst"},
+	},
+	{ // Origin mode clips the area to the margins
+		i: "\x1b[2;3r\x1b[?69h\x1b[2;4s\x1b[?6h\x1b[2;2;9;9$z",
+		o: []string{"abcde", "fghij", "kl  o", "pqrst"},
+	},
+}
+
+func TestRectangles(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		for idx, test := range rectTests {
+			display := NewDisplay(5, 4)
+			var disp CharDisplay = display
+			if plain {
+				disp = plainDisplay{display}
+			}
+			emul := NewEmulator(nil, nil, disp)
+			emul.Write([]byte("abcde\r\nfghij\r\nklmno\r\npqrst"))
+			emul.Write([]byte(test.i))
+
+			lines := screenLines(display)
+			for i, expected := range test.o {
+				if lines[i] != expected {
+					t.Errorf("test %d (plain=%v): got %q, expected %q",
+						idx, plain, lines, test.o)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestRectangleAttributes(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		display := NewDisplay(5, 3)
+		var disp CharDisplay = display
+		if plain {
+			disp = plainDisplay{display}
+		}
+		emul := NewEmulator(nil, nil, disp)
+		emul.Write([]byte("abcde\r\nfghij\r\nklmno"))
+
+		// DECCARA with the default stream extent.
+		emul.Write([]byte("\x1b[1;4;2;2;1;4$r"))
+		for y, line := range display.Lines {
+			for x, ch := range line {
+				set := (y == 0 && x >= 3) || (y == 1 && x <= 1)
+				if ch.Bold != set || ch.Underline != set {
+					t.Errorf("plain=%v: DECCARA stream (%d,%d): %v",
+						plain, x, y, ch)
+				}
+			}
+		}
+
+		// DECRARA with the rectangle extent.
+		emul.Write([]byte("\x1b[2*x\x1b[1;1;2;4;1$t"))
+		for y, line := range display.Lines {
+			for x, ch := range line {
+				set := (y == 0 && x >= 3) || (y == 1 && x <= 1)
+				if y <= 1 && x <= 3 {
+					set = !set
+				}
+				if ch.Bold != set {
+					t.Errorf("plain=%v: DECRARA (%d,%d): %v", plain, x, y, ch)
+				}
+			}
+		}
+
+		// DECCARA reset.
+		emul.Write([]byte("\x1b[$r"))
+		for y, line := range display.Lines {
+			for x, ch := range line {
+				if ch.Bold || ch.Underline {
+					t.Errorf("plain=%v: DECCARA 0 (%d,%d): %v",
+						plain, x, y, ch)
+				}
+			}
+		}
+	}
+}
+
+func TestRectangleChecksum(t *testing.T) {
+	var out bytes.Buffer
+	display := NewDisplay(5, 3)
+	emul := NewEmulator(&out, nil, display)
+	emul.Write([]byte("ab\x1b[1mc"))
+
+	emul.Write([]byte("\x1b[1;1;1;1;1;2*y"))
+	emul.Write([]byte("\x1b[2;1;1;1;1;3*y"))
+	emul.Write([]byte("\x1b[3;1;2;1;2;2*y"))
+
+	expected := "\x1bP1!~FF3D\x1b\\" +
+		"\x1bP2!~FE5A\x1b\\" +
+		"\x1bP3!~FFC0\x1b\\"
+	if out.String() != expected {
+		t.Errorf("DECRQCRA: got %q, expected %q", out.String(), expected)
+	}
+}
+
+// setCounter counts the Set calls of its display.
+type setCounter struct {
+	CharDisplay
+	sets int
+}
+
+func (d *setCounter) Set(p Point, char Char) {
+	d.sets++
+	d.CharDisplay.Set(p, char)
+}
+
+func TestRectangleChecksumReadOnly(t *testing.T) {
+	var out bytes.Buffer
+	display := &setCounter{
+		CharDisplay: NewDisplay(5, 3),
+	}
+	emul := NewEmulator(&out, nil, display)
+	emul.Write([]byte("ab\x1b[1mc"))
+	display.sets = 0
+
+	emul.Write([]byte("\x1b[1;1;1;1;1;2*y\x1b[2;1*y"))
+	if display.sets != 0 {
+		t.Errorf("DECRQCRA: %d Set calls", display.sets)
+	}
+	if !strings.HasPrefix(out.String(), "\x1bP1!~FF3D\x1b\\") {
+		t.Errorf("DECRQCRA: got %q", out.String())
+	}
+
+	out.Reset()
+	stringer := NewStringer()
+	emul = NewEmulator(&out, nil, stringer)
+	emul.Write([]byte("ab\x1b[1mc\x1b[1;1;1;1;1;3*y\x1b[2;1;1;1;2;5*y"))
+	// The stringer does not store the character attributes and the
+	// characters outside its content are blanks.
+	if out.String() != "\x1bP1!~FEDA\x1b\\\x1bP2!~FDFA\x1b\\" {
+		t.Errorf("Stringer DECRQCRA: got %q", out.String())
+	}
+
+	// The unlimited default area reads only the content.
+	out.Reset()
+	emul.Write([]byte("\x1b[3;1*y"))
+	if !strings.HasPrefix(out.String(), "\x1bP3!~") {
+		t.Errorf("Stringer DECRQCRA: got %q", out.String())
+	}
+}
+
+func TestTrimRectangles(t *testing.T) {
+	lines, err := Trim("abc\r\nde\x1b[1;1;2;3;1;2;2;1$v\x1b[42;1;3;1;9$x")
+	if err != nil {
+		t.Fatalf("Trim failed: %s", err)
+	}
+	expected := []string{"ab**", "dabc", " de"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Trim: got %q, expected %q", lines, expected)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("Trim: got %q, expected %q", lines, expected)
+			break
+		}
+	}
+}
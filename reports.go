@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DeviceAttributes define the terminal identification that the
+// emulator reports to the host with the Device Attributes (DA)
+// replies.
+type DeviceAttributes struct {
+	// Primary specifies the service class and the supported
+	// features of the Primary DA (DA1) reply.
+	Primary []int
+	// Secondary specifies the terminal type, firmware version, and
+	// ROM cartridge registration number of the Secondary DA (DA2)
+	// reply.
+	Secondary []int
+	// UnitID specifies the 8 hex digit unit ID of the Tertiary DA
+	// (DA3) reply.
+	UnitID string
+}
+
+// Device attributes for the emulated terminal levels.
+var (
+	VT100Attributes = DeviceAttributes{
+		Primary:   []int{1, 2},
+		Secondary: []int{0, 95, 0},
+		UnitID:    "00000000",
+	}
+	VT220Attributes = DeviceAttributes{
+		Primary:   []int{62, 1, 2, 7, 8, 9, 15, 18, 21, 44, 45, 46},
+		Secondary: []int{1, 10, 0},
+		UnitID:    "00000000",
+	}
+	VT420Attributes = DeviceAttributes{
+		Primary:   []int{64, 1, 2, 6, 7, 8, 9, 15, 18, 21, 22, 28, 29},
+		Secondary: []int{41, 10, 0},
+		UnitID:    "00000000",
+	}
+)
+
+// DECRQM mode status values.
+const (
+	modeNotRecognized = iota
+	modeSet
+	modeReset
+	modePermanentlySet
+	modePermanentlyReset
+)
+
+func modeValue(set bool) int {
+	if set {
+		return modeSet
+	}
+	return modeReset
+}
+
+// modeStatus returns the DECRQM status of the ANSI or DEC private
+// mode.
+func (e *Emulator) modeStatus(private bool, mode int) int {
+	if private {
+		switch mode {
+		case 2: // DECANM
+			return modeValue(!e.parser.VT52())
+		case 6: // DECOM
+			return modeValue(e.originMode)
+		case 7: // DECAWM
+			return modeValue(e.autoWrap)
+		case 47, 1047, 1049: // Alternate Screen Buffer
+			return modeValue(e.alternate)
+		case 69: // DECLRMM
+			return modeValue(e.leftRightMode)
+		default:
+			return modeNotRecognized
+		}
+	}
+	switch mode {
+	case 4: // IRM
+		return modeValue(e.insertMode)
+	case 20: // LNM
+		return modeValue(e.newlineMode)
+	default:
+		return modeNotRecognized
+	}
+}
+
+func formatParams(params []int) string {
+	var parts []string
+	for _, p := range params {
+		parts = append(parts, strconv.Itoa(p))
+	}
+	return strings.Join(parts, ";")
+}
+
+// reportPosition returns the cursor position for the position
+// reports. The position is relative to the scrolling region and the
+// left margin in the origin mode.
+func (e *Emulator) reportPosition() (row, col int) {
+	row = e.Cursor.Y + 1
+	col = e.Cursor.X + 1
+	if e.originMode {
+		row -= e.scrollTop
+		col -= e.scrollLeft
+	}
+	return
+}
+
+func (e *Emulator) deviceStatusReport(private bool, mode int) {
+	if private {
+		switch mode {
+		case 6: // DECXCPR - Extended Cursor Position Report
+			row, col := e.reportPosition()
+			e.output("\x1b[?%d;%d;1R", row, col)
+
+		default:
+			e.debug("unsupported DSR: ESC[?%dn", mode)
+		}
+		return
+	}
+	switch mode {
+	case 5: // Status Report
+		e.output("\x1b[0n")
+
+	case 6: // CPR - Cursor Position Report
+		row, col := e.reportPosition()
+		e.output("\x1b[%d;%dR", row, col)
+
+	default:
+		e.debug("unsupported DSR: ESC[%dn", mode)
+	}
+}
+
+func (e *Emulator) deviceAttributes(prefix string, param int) {
+	if param != 0 {
+		e.debug("unsupported DA: ESC[%s%dc", prefix, param)
+		return
+	}
+	switch prefix {
+	case "": // Primary DA
+		e.output("\x1b[?%sc", formatParams(e.DeviceAttributes.Primary))
+
+	case ">": // Secondary DA
+		e.output("\x1b[>%sc", formatParams(e.DeviceAttributes.Secondary))
+
+	case "=": // Tertiary DA
+		e.output("\x1bP!|%s\x1b\\", e.DeviceAttributes.UnitID)
+
+	default:
+		e.debug("unsupported DA: ESC[%s%dc", prefix, param)
+	}
+}
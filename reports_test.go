@@ -0,0 +1,72 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"bytes"
+	"testing"
+)
+
+var reportTests = []struct {
+	i string
+	o string
+}{
+	{
+		i: "\x1b[5n",
+		o: "\x1b[0n",
+	},
+	{
+		i: "\x1b[3;5H\x1b[6n",
+		o: "\x1b[3;5R",
+	},
+	{
+		i: "\x1b[2;4r\x1b[?6h\x1b[2;3H\x1b[6n\x1b[?6n",
+		o: "\x1b[2;3R\x1b[?2;3;1R",
+	},
+	{
+		i: "\x1b[?69h\x1b[3;6s\x1b[?6h\x1b[2;3H\x1b[6n",
+		o: "\x1b[2;3R",
+	},
+	{
+		i: "\x1b[?69$p\x1b[?69h\x1b[?69$p",
+		o: "\x1b[?69;2$y\x1b[?69;1$y",
+	},
+	{
+		i: "\x1b[c\x1b[0c",
+		o: "\x1b[?62;1;2;7;8;9;15;18;21;44;45;46c" +
+			"\x1b[?62;1;2;7;8;9;15;18;21;44;45;46c",
+	},
+	{
+		i: "\x1b[>c",
+		o: "\x1b[>1;10;0c",
+	},
+	{
+		i: "\x1b[=c",
+		o: "\x1bP!|00000000\x1b\\",
+	},
+}
+
+func TestReports(t *testing.T) {
+	for idx, test := range reportTests {
+		var out bytes.Buffer
+		emul := NewEmulator(&out, nil, NewDisplay(10, 5))
+		emul.Write([]byte(test.i))
+		if out.String() != test.o {
+			t.Errorf("test %d: got %q, expected %q", idx, out.String(), test.o)
+		}
+	}
+}
+
+func TestDeviceAttributes(t *testing.T) {
+	var out bytes.Buffer
+	emul := NewEmulator(&out, nil, NewDisplay(10, 5))
+	emul.DeviceAttributes = VT100Attributes
+	emul.Write([]byte("\x1b[c"))
+	if out.String() != "\x1b[?1;2c" {
+		t.Errorf("DA1: got %q", out.String())
+	}
+}
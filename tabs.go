@@ -0,0 +1,107 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	tabWidth = 8
+
+	// maxTabReportWidth limits the DECTABSR report for displays with
+	// unlimited width.
+	maxTabReportWidth = 1024
+)
+
+// The emulator tab stops are stored in the tabs slice which covers
+// the columns that have been modified with HTS or TBC. The columns
+// beyond the slice have default tab stops at every 8 columns if
+// tabsDefault is set.
+
+func (e *Emulator) resetTabStops() {
+	e.tabs = nil
+	e.tabsDefault = true
+}
+
+func (e *Emulator) clearTabStops() {
+	e.tabs = nil
+	e.tabsDefault = false
+}
+
+func (e *Emulator) isTabStop(x int) bool {
+	if x < len(e.tabs) {
+		return e.tabs[x]
+	}
+	return e.tabsDefault && x%tabWidth == 0
+}
+
+func (e *Emulator) setTabStop(x int, set bool) {
+	if x < 0 || x >= e.Size.X {
+		return
+	}
+	for len(e.tabs) <= x {
+		e.tabs = append(e.tabs, e.isTabStop(len(e.tabs)))
+	}
+	e.tabs[x] = set
+}
+
+// nextTabStop returns the column of the next tab stop after x or the
+// right margin if there are no more tab stops.
+func (e *Emulator) nextTabStop(x int) int {
+	for x++; x < len(e.tabs) && x < e.Size.X; x++ {
+		if e.tabs[x] {
+			return x
+		}
+	}
+	if e.tabsDefault {
+		x = (x + tabWidth - 1) / tabWidth * tabWidth
+	} else {
+		x = e.Size.X
+	}
+	if x >= e.Size.X {
+		x = e.Size.X - 1
+	}
+	return x
+}
+
+// prevTabStop returns the column of the previous tab stop before x or
+// the left margin if there are no more tab stops.
+func (e *Emulator) prevTabStop(x int) int {
+	if x > len(e.tabs) {
+		if e.tabsDefault {
+			stop := (x - 1) / tabWidth * tabWidth
+			if stop >= len(e.tabs) {
+				return stop
+			}
+		}
+		x = len(e.tabs)
+	}
+	for x--; x > 0; x-- {
+		if e.tabs[x] {
+			return x
+		}
+	}
+	return 0
+}
+
+// tabStopReport creates the DECTABSR tab stop report listing the tab
+// stop columns separated by '/'.
+func (e *Emulator) tabStopReport() string {
+	width := e.Size.X
+	if width > maxTabReportWidth {
+		width = maxTabReportWidth
+	}
+	var stops []string
+	for x := 1; x < width; x++ {
+		if e.isTabStop(x) {
+			stops = append(stops, strconv.Itoa(x+1))
+		}
+	}
+	return strings.Join(stops, "/")
+}
@@ -10,18 +10,26 @@ import (
 	"io"
 	"math"
 	"os"
+	"strings"
+	"unicode/utf8"
 )
 
 var (
-	_      CharDisplay = &Stringer{}
-	stdout             = io.Discard
-	stderr             = io.Discard
+	_      CharDisplay    = &Stringer{}
+	_      RectDisplay    = &Stringer{}
+	_      ContentDisplay = &Stringer{}
+	stdout                = io.Discard
+	stderr                = io.Discard
 )
 
 // Stringer implements the CharDisplay interface to create plain-text
-// string versions of the input.
+// string versions of the input. Each line column holds the grapheme
+// cluster of the column character. The right half of a wide
+// character is stored as an empty string.
 type Stringer struct {
-	lines [][]rune
+	lines     [][]string
+	other     [][]string
+	alternate bool
 }
 
 // NewStringer creates a new stringer display.
@@ -43,11 +51,14 @@ func (d *Stringer) Clear(from, to Point) {
 		if y >= len(d.lines) {
 			return
 		}
+		if from.X >= len(d.lines[y]) {
+			continue
+		}
 		if to.X >= len(d.lines[y]) {
 			d.lines[y] = d.lines[y][:from.X]
 		} else {
 			for x := from.X; x <= to.X; x++ {
-				d.lines[y][x] = ' '
+				d.lines[y][x] = " "
 			}
 		}
 	}
@@ -57,12 +68,7 @@ func (d *Stringer) Clear(from, to Point) {
 func (d *Stringer) DECALN(size Point) {
 	if size.X == math.MaxInt32 {
 		// Take the maximum line width.
-		size.X = 0
-		for _, line := range d.lines {
-			if len(line) > size.X {
-				size.X = len(line)
-			}
-		}
+		size.X = d.width()
 		if size.X == 0 {
 			size.X = 80
 		}
@@ -84,35 +90,163 @@ func (d *Stringer) DECALN(size Point) {
 	}
 }
 
-// Set implements the CharDisplay.Set function.
+// Set implements the CharDisplay.Set function. If the character
+// overwrites a half of a wide character, the other half is cleared.
 func (d *Stringer) Set(p Point, char Char) {
 	for len(d.lines) <= p.Y {
-		d.lines = append(d.lines, []rune{})
+		d.lines = append(d.lines, []string{})
 	}
 	for len(d.lines[p.Y]) <= p.X {
-		d.lines[p.Y] = append(d.lines[p.Y], ' ')
+		d.lines[p.Y] = append(d.lines[p.Y], " ")
+	}
+	line := d.lines[p.Y]
+	if !char.Continuation && len(line[p.X]) == 0 && p.X > 0 {
+		line[p.X-1] = " "
+	}
+	if !char.Wide && p.X+1 < len(line) && len(line[p.X+1]) == 0 {
+		line[p.X+1] = " "
+	}
+	line[p.X] = char.Grapheme()
+}
+
+// width returns the maximum line width.
+func (d *Stringer) width() int {
+	var width int
+	for _, line := range d.lines {
+		if len(line) > width {
+			width = len(line)
+		}
+	}
+	return width
+}
+
+// ContentSize implements the ContentDisplay.ContentSize function.
+func (d *Stringer) ContentSize() Point {
+	return Point{
+		X: d.width(),
+		Y: len(d.lines),
+	}
+}
+
+// Get implements the CharDisplay.Get function.
+func (d *Stringer) Get(p Point) Char {
+	if p.Y >= len(d.lines) || p.X >= len(d.lines[p.Y]) {
+		return Char{
+			Code: ' ',
+		}
+	}
+	line := d.lines[p.Y]
+	if len(line[p.X]) == 0 {
+		return Char{
+			Continuation: true,
+		}
+	}
+	r, n := utf8.DecodeRuneInString(line[p.X])
+	return Char{
+		Code:      r,
+		Combining: line[p.X][n:],
+		Wide:      p.X+1 < len(line) && len(line[p.X+1]) == 0,
+	}
+}
+
+// FillRect implements the RectDisplay.FillRect function. The area is
+// clipped to the stored lines and the maximum line width.
+func (d *Stringer) FillRect(from, to Point, char Char) {
+	if width := d.width(); to.X >= width {
+		to.X = width - 1
+	}
+	if to.Y >= len(d.lines) {
+		to.Y = len(d.lines) - 1
+	}
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y; p.Y++ {
+		for p.X = from.X; p.X <= to.X; p.X++ {
+			d.Set(p, char)
+		}
+	}
+}
+
+// CopyRect implements the RectDisplay.CopyRect function. Only the
+// stored lines are copied and the cells beyond the source lines are
+// copied as blanks.
+func (d *Stringer) CopyRect(from, to, dst Point) {
+	var rows [][]string
+	for y := from.Y; y <= to.Y && y < len(d.lines); y++ {
+		var row []string
+		for x := from.X; x <= to.X && x < len(d.lines[y]); x++ {
+			row = append(row, d.lines[y][x])
+		}
+		rows = append(rows, row)
+	}
+	for i := 0; i <= to.Y-from.Y; i++ {
+		y := dst.Y + i
+		if i >= len(rows) && y >= len(d.lines) {
+			break
+		}
+		var row []string
+		if i < len(rows) {
+			row = rows[i]
+		}
+		for j := 0; j <= to.X-from.X; j++ {
+			x := dst.X + j
+			if j < len(row) {
+				for len(d.lines) <= y {
+					d.lines = append(d.lines, []string{})
+				}
+				for len(d.lines[y]) <= x {
+					d.lines[y] = append(d.lines[y], " ")
+				}
+				d.lines[y][x] = row[j]
+			} else if y < len(d.lines) && x < len(d.lines[y]) {
+				d.lines[y][x] = " "
+			} else {
+				break
+			}
+		}
+	}
+}
+
+// ModifyRect implements the RectDisplay.ModifyRect function. The
+// area is clipped to the stored lines.
+func (d *Stringer) ModifyRect(from, to Point, modify func(ch Char) Char) {
+	var p Point
+	for p.Y = from.Y; p.Y <= to.Y && p.Y < len(d.lines); p.Y++ {
+		line := d.lines[p.Y]
+		for p.X = from.X; p.X <= to.X && p.X < len(line); p.X++ {
+			line[p.X] = modify(d.Get(p)).Grapheme()
+		}
 	}
-	d.lines[p.Y][p.X] = char.Code
+}
+
+// SelectiveErase implements the RectDisplay.SelectiveErase
+// function. The stringer does not store the character protection so
+// all characters are erased.
+func (d *Stringer) SelectiveErase(from, to Point) {
+	d.Clear(from, to)
 }
 
 // InsertChars implements the CharDisplay.InsertChars function.
 func (d *Stringer) InsertChars(size, p Point, count int) {
 	for len(d.lines) <= p.Y {
-		d.lines = append(d.lines, []rune{})
+		d.lines = append(d.lines, []string{})
 	}
-	var line []rune
+	orig, tail := d.splitLine(p.Y, size.X)
+	var line []string
 	for x := 0; x < p.X; x++ {
-		if x < len(d.lines[p.Y]) {
-			line = append(line, d.lines[p.Y][x])
+		if x < len(orig) {
+			line = append(line, orig[x])
 		} else {
-			line = append(line, ' ')
+			line = append(line, " ")
 		}
 	}
 	for x := 0; x < count; x++ {
-		line = append(line, ' ')
+		line = append(line, " ")
+	}
+	for x := p.X; x < len(orig); x++ {
+		line = append(line, orig[x])
 	}
-	for x := p.X; x < len(d.lines[p.Y]); x++ {
-		line = append(line, d.lines[p.Y][x])
+	if tail != nil {
+		line = append(line[:size.X], tail...)
 	}
 	d.lines[p.Y] = line
 }
@@ -122,38 +256,159 @@ func (d *Stringer) DeleteChars(size, p Point, count int) {
 	if p.Y >= len(d.lines) || p.X >= len(d.lines[p.Y]) {
 		return
 	}
-	line := d.lines[p.Y][:p.X]
-	if p.X+count < len(d.lines[p.Y]) {
-		line = append(line, d.lines[p.Y][p.X+count:]...)
+	orig, tail := d.splitLine(p.Y, size.X)
+	line := append([]string{}, orig[:p.X]...)
+	if p.X+count < len(orig) {
+		line = append(line, orig[p.X+count:]...)
+	}
+	if tail != nil {
+		for len(line) < size.X {
+			line = append(line, " ")
+		}
+		line = append(line, tail...)
 	}
 	d.lines[p.Y] = line
 }
 
-// ScrollUp implements the CharDisplay.ScrollUp function.
-func (d *Stringer) ScrollUp(top, bottom, count int) {
-	var lines [][]rune
+// splitLine splits the line at the column width. The tail is nil if
+// the line is not longer than width.
+func (d *Stringer) splitLine(row, width int) (head, tail []string) {
+	line := d.lines[row]
+	if width >= len(line) {
+		return line, nil
+	}
+	return line[:width], append([]string{}, line[width:]...)
+}
+
+// fullWidth tests if the column range covers the full line width.
+func (d *Stringer) fullWidth(left, right int) bool {
+	return left == 0 && right >= d.Size().X-1
+}
 
-	for i := 0; i < top; i++ {
-		if i < len(d.lines) {
-			lines = append(lines, d.lines[i])
+// copyCells copies the column range left-right from the line src to
+// the line dst.
+func (d *Stringer) copyCells(dst, src, left, right int) {
+	for x := left; x <= right; x++ {
+		var cell string
+		if x < len(d.lines[src]) {
+			cell = d.lines[src][x]
+		} else if x >= len(d.lines[dst]) {
+			break
 		} else {
-			lines = append(lines, nil)
+			cell = " "
+		}
+		for len(d.lines[dst]) <= x {
+			d.lines[dst] = append(d.lines[dst], " ")
 		}
+		d.lines[dst][x] = cell
 	}
-	for i := top + count; i <= bottom; i++ {
-		if i < len(d.lines) {
-			lines = append(lines, d.lines[i])
-		} else {
-			lines = append(lines, nil)
+}
+
+// clearCells clears the column range left-right of the line.
+func (d *Stringer) clearCells(row, left, right int) {
+	for x := left; x <= right && x < len(d.lines[row]); x++ {
+		d.lines[row][x] = " "
+	}
+}
+
+// ScrollUp implements the CharDisplay.ScrollUp function.
+func (d *Stringer) ScrollUp(top, bottom, left, right, count int) {
+	d.DeleteLines(top, bottom, left, right, count)
+}
+
+// ScrollDown implements the CharDisplay.ScrollDown function.
+func (d *Stringer) ScrollDown(top, bottom, left, right, count int) {
+	d.InsertLines(top, bottom, left, right, count)
+}
+
+// InsertLines implements the CharDisplay.InsertLines function.
+func (d *Stringer) InsertLines(row, bottom, left, right, count int) {
+	if row >= len(d.lines) {
+		return
+	}
+	// Lines below the last stored line are blank so the region
+	// needs to grow only as much as the inserted lines need.
+	end := len(d.lines) + count
+	if end > bottom+1 {
+		end = bottom + 1
+	}
+	for len(d.lines) < end {
+		d.lines = append(d.lines, nil)
+	}
+	if bottom >= len(d.lines) {
+		bottom = len(d.lines) - 1
+	}
+	if count > bottom-row+1 {
+		count = bottom - row + 1
+	}
+	if !d.fullWidth(left, right) {
+		for y := bottom; y >= row+count; y-- {
+			d.copyCells(y, y-count, left, right)
+		}
+		for y := row; y < row+count; y++ {
+			d.clearCells(y, left, right)
 		}
+		return
 	}
+	copy(d.lines[row+count:bottom+1], d.lines[row:bottom+1-count])
 	for i := 0; i < count; i++ {
-		lines = append(lines, nil)
+		d.lines[row+i] = nil
 	}
-	for i := bottom + 1; i < len(d.lines); i++ {
-		lines = append(lines, d.lines[i])
+}
+
+// DeleteLines implements the CharDisplay.DeleteLines function.
+func (d *Stringer) DeleteLines(row, bottom, left, right, count int) {
+	if row >= len(d.lines) {
+		return
+	}
+	if bottom >= len(d.lines) {
+		bottom = len(d.lines) - 1
+	}
+	if count > bottom-row+1 {
+		count = bottom - row + 1
+	}
+	if !d.fullWidth(left, right) {
+		for y := row; y <= bottom-count; y++ {
+			d.copyCells(y, y+count, left, right)
+		}
+		for y := bottom - count + 1; y <= bottom; y++ {
+			d.clearCells(y, left, right)
+		}
+		return
+	}
+	copy(d.lines[row:bottom+1-count], d.lines[row+count:bottom+1])
+	for i := bottom - count + 1; i <= bottom; i++ {
+		d.lines[i] = nil
+	}
+}
+
+// ClearScrollback implements the CharDisplay.ClearScrollback
+// function.
+func (d *Stringer) ClearScrollback() {
+}
+
+// SetWrapped implements the CharDisplay.SetWrapped function.
+func (d *Stringer) SetWrapped(row int, wrapped bool) {
+}
+
+// SetLineSize implements the CharDisplay.SetLineSize function. The
+// stringer display has unlimited width so the line sizes are
+// ignored.
+func (d *Stringer) SetLineSize(row int, size LineSize) {
+}
+
+// LineSize implements the CharDisplay.LineSize function.
+func (d *Stringer) LineSize(row int) LineSize {
+	return LineSingle
+}
+
+// SwitchScreen implements the CharDisplay.SwitchScreen function.
+func (d *Stringer) SwitchScreen(alternate bool) {
+	if alternate == d.alternate {
+		return
 	}
-	d.lines = lines
+	d.lines, d.other = d.other, d.lines
+	d.alternate = alternate
 }
 
 // DisplayWidth computes the character size width of the argument data
@@ -161,9 +416,7 @@ func (d *Stringer) ScrollUp(top, bottom, count int) {
 func DisplayWidth(data string) (width, height int, err error) {
 	disp := NewStringer()
 	emul := NewEmulator(stdout, stderr, disp)
-	for _, r := range []rune(data) {
-		emul.Input(int(r))
-	}
+	emul.Write([]byte(data))
 
 	for _, line := range disp.lines {
 		if len(line) > width {
@@ -184,12 +437,10 @@ func Trim(data string) (lines []string, err error) {
 		e = os.Stderr
 	}
 	emul := NewEmulator(stdout, e, disp)
-	for _, r := range []rune(data) {
-		emul.Input(int(r))
-	}
+	emul.Write([]byte(data))
 
 	for _, line := range disp.lines {
-		lines = append(lines, string(line))
+		lines = append(lines, strings.Join(line, ""))
 	}
 
 	return
@@ -36,6 +36,24 @@ var widthTests = []struct {
 		w: 13,
 		h: 1,
 	},
+	{
+		i: "日本語 text",
+		o: []string{"日本語 text"},
+		w: 11,
+		h: 1,
+	},
+	{
+		i: "cafe\u0301 \U0001f469\u200d\U0001f4bb!",
+		o: []string{"cafe\u0301 \U0001f469\u200d\U0001f4bb!"},
+		w: 8,
+		h: 1,
+	},
+	{
+		i: "abc\x1b[10G\x1b[K",
+		o: []string{"abc"},
+		w: 3,
+		h: 1,
+	},
 }
 
 func TestDisplayWidth(t *testing.T) {
@@ -0,0 +1,86 @@
+//
+// Copyright (c) 2021 Markku Rossi
+//
+// All rights reserved.
+//
+
+package vt100
+
+import (
+	"testing"
+)
+
+var runeWidthTests = []struct {
+	r rune
+	w int
+}{
+	{'a', 1},
+	{0xe4, 1},
+	{0x0301, 0},
+	{0x200d, 0},
+	{0xfe0f, 0},
+	{0x3042, 2},
+	{0x65e5, 2},
+	{0xac00, 2},
+	{0xff21, 2},
+	{0xff61, 1},
+	{0x1f600, 2},
+	{0x2500, 1},
+}
+
+func TestRuneWidth(t *testing.T) {
+	for _, test := range runeWidthTests {
+		w := RuneWidth(test.r)
+		if w != test.w {
+			t.Errorf("RuneWidth(%U)=%d, expected %d", test.r, w, test.w)
+		}
+	}
+}
+
+func TestWideChars(t *testing.T) {
+	emul, display := newTestEmulator(5, 2)
+
+	emul.Write([]byte("ab日本"))
+	if lineString(display, 0) != "ab日 " || lineString(display, 1) != "本   " {
+		t.Errorf("wide wrap: %q", screenLines(display))
+	}
+	if !display.Lines[0][2].Wide || !display.Lines[0][3].Continuation {
+		t.Errorf("wide cells: %+v", display.Lines[0][2:4])
+	}
+	if !display.Wrapped(0) {
+		t.Errorf("wide wrap did not set wrap flag")
+	}
+
+	// Overwriting the right half clears the left half.
+	emul.Write([]byte("\x1b[1;4Hx"))
+	if lineString(display, 0) != "ab x " {
+		t.Errorf("overwrite: %q", lineString(display, 0))
+	}
+
+	// ICH pushes the continuation off the line.
+	emul.Write([]byte("\x1b[2;1H\x1b[4@"))
+	if lineString(display, 1) != "     " {
+		t.Errorf("ICH: %q", lineString(display, 1))
+	}
+
+	// DCH inside a wide character.
+	emul.Write([]byte("\x1b[2;1H語x\x1b[2;2H\x1b[P"))
+	if lineString(display, 1) != " x   " {
+		t.Errorf("DCH: %q", lineString(display, 1))
+	}
+}
+
+func TestCombiningChars(t *testing.T) {
+	emul, display := newTestEmulator(4, 1)
+
+	emul.Write([]byte("é̂x\U0001f469‍\U0001f4bb"))
+	if display.Lines[0][0].Grapheme() != "é̂" {
+		t.Errorf("combining: %q", display.Lines[0][0].Grapheme())
+	}
+	if display.Lines[0][2].Grapheme() != "\U0001f469‍\U0001f4bb" {
+		t.Errorf("ZWJ: %q", display.Lines[0][2].Grapheme())
+	}
+	if !emul.Cursor.Equal(Point{X: 3, Y: 0}) || !emul.overflow {
+		t.Errorf("cursor %v", emul.Cursor)
+	}
+}